@@ -0,0 +1,542 @@
+//
+//	Syntax tree of a configuration file.
+//
+//	ParseAST reads a configuration file without a Go struct to
+//	put it in, and returns the document as a tree of sections,
+//	statements and values, with their positions and comments.
+//	Decode puts (part of) the tree into a struct, like Parse.
+//
+
+package curlyconf
+
+import (
+	"strconv"
+)
+
+// Position in a configuration file. Line and Column start at 1,
+// Offset is the byte offset from the start of the file.
+type Position struct {
+	File	string
+	Line	int
+	Column	int
+	Offset	int
+}
+
+// A Node is a *Section or a *Statement.
+type Node interface {
+	Pos() Position		// position of the first character
+	End() Position		// position just after the node
+}
+
+// A Comment, including the leading # or //.
+type Comment struct {
+	Text	string
+	Start	Position
+	Stop	Position
+}
+
+// A Value, like an argument of a statement or the name of a section.
+type Value struct {
+	Text	string		// the value, unquoted if it was a string
+	Raw	string		// the value as written in the file
+	Class	TokenClass	// classes of the token
+	Start	Position
+	Stop	Position
+	Dir	string		// directory of the file, for relative paths
+	tok	*tokInfo
+}
+
+// A Statement: a keyword followed by values.
+//
+// Because sections can be flattened ("person snoopy address 5.6.7.8;")
+// without a Go struct it is not known where the section name ends
+// and the statement within the section starts. Those are returned
+// as one statement with all values in Values, and Decode sorts
+// it out.
+type Statement struct {
+	Key		string
+	KeyPos		Position
+	Values		[]*Value
+	Comments	[]*Comment	// comments on the lines before
+	LineComment	*Comment	// comment after the statement
+	Stop		Position
+	keyTok		*tokInfo
+	endTok		*tokInfo
+}
+
+// A Section: a keyword, optional arguments (normally the name)
+// and a block with statements.
+type Section struct {
+	Key		string
+	KeyPos		Position
+	Args		[]*Value
+	Body		[]Node
+	Open		Position	// start of the block: '{' or newline
+	Close		Position	// end of the block: '}' or "end"
+	Comments	[]*Comment
+	LineComment	*Comment
+	Trailing	[]*Comment	// comments after the last statement
+	Stop		Position
+	keyTok		*tokInfo
+}
+
+// A Document is a parsed configuration file.
+type Document struct {
+	File		string
+	Body		[]Node
+	Trailing	[]*Comment
+	parserType	int
+	data		[]byte
+}
+
+func (s *Statement) Pos() Position { return s.KeyPos }
+func (s *Statement) End() Position { return s.Stop }
+func (s *Section) Pos() Position { return s.KeyPos }
+func (s *Section) End() Position { return s.Stop }
+
+// Name returns the name of the section, or "" if it has none.
+func (s *Section) Name() string {
+	if len(s.Args) == 1 {
+		return s.Args[0].Text
+	}
+	return ""
+}
+
+func newValue(t *tokInfo) *Value {
+	v := &Value{
+		Text: string(t.Value),
+		Raw: string(t.Value),
+		Class: TokenClass(t.Token & tokAny &^ tokValue),
+		Start: t.Position(),
+		Stop: t.EndPosition(),
+		Dir: t.tkz.Dir(),
+		tok: t,
+	}
+	if len(v.Raw) > 0 && v.Raw[0] == '"' {
+		s, err := strconv.Unquote(v.Raw)
+		if err == nil {
+			v.Text = s
+		}
+	}
+	return v
+}
+
+func newComment(t *tokInfo) *Comment {
+	return &Comment{
+		Text: string(t.Value),
+		Start: t.Position(),
+		Stop: t.EndPosition(),
+	}
+}
+
+// ParseAST parses the configuration file into a syntax tree.
+// Include statements are returned as normal statements, the
+// included files are not read.
+//
+// In the ParserDiablo format the start of a section cannot be
+// seen, only its "end". The section header is taken to be the
+// statement at the same indentation as "end" that is followed
+// by indented lines, or if the section is not indented, the first
+// statement at the same indentation after the previous section.
+func (p *Parser) ParseAST() (doc *Document, err error) {
+	p.tok.keep = true
+	doc = &Document{
+		File: p.tok.file,
+		parserType: p.parserType,
+		data: p.tok.data,
+	}
+	if p.sectionEnd == tokEnd {
+		doc.Body, doc.Trailing = p.astLines()
+	} else {
+		doc.Body, doc.Trailing, _ = p.astBody(tokEOF)
+	}
+	if p.errCount > 0 {
+		if p.errCount > p.maxErrors && p.errCount != 1000 {
+			p.report(nil, CodeTooMany, "too many errors", nil)
+		}
+		err = &p.errors
+	}
+	return
+}
+
+//
+//	Attach comments seen since the last call to the previous node
+//	(if on the same line) or return them as leading comments.
+//
+func (p *Parser) astComments(prev Node) (leading []*Comment) {
+	for _, t := range p.tok.comments {
+		c := newComment(t)
+		switch n := prev.(type) {
+			case *Statement:
+				if n.LineComment == nil && c.Start.Line == n.endTok.Pos.Line {
+					n.LineComment = c
+					continue
+				}
+			case *Section:
+				if n.LineComment == nil && c.Start.Line == n.Close.Line {
+					n.LineComment = c
+					continue
+				}
+		}
+		leading = append(leading, c)
+	}
+	p.tok.comments = nil
+	return
+}
+
+//
+//	Parse statements up to the "end" token.
+//
+func (p *Parser) astBody(end uint64) (nodes []Node, trailing []*Comment, close *tokInfo) {
+	var prev Node
+	for {
+		p.peekToken()
+		comments := p.astComments(prev)
+		if close = p.accept(end); close != nil {
+			trailing = comments
+			return
+		}
+		if t := p.accept(p.stmtEnd); t != nil {
+			trailing = append(trailing, comments...)
+			continue
+		}
+		n := p.astStmt()
+		if n == nil {
+			if p.errCount > p.maxErrors {
+				return
+			}
+			continue
+		}
+		switch s := n.(type) {
+			case *Statement:
+				s.Comments = append(trailing, comments...)
+			case *Section:
+				s.Comments = append(trailing, comments...)
+		}
+		trailing = nil
+		nodes = append(nodes, n)
+		prev = n
+	}
+}
+
+//
+//	Parse a statement or section (ParserSemi and ParserNL).
+//
+func (p *Parser) astStmt() Node {
+	key, ok := p.expect(tokIdent, "identifier")
+	if !ok {
+		p.recover(key)
+		return nil
+	}
+	var args []*Value
+	for {
+		if open := p.accept(p.sectionStart); open != nil {
+			sec := &Section{
+				Key: string(key.Value),
+				KeyPos: key.Position(),
+				Args: args,
+				Open: open.Position(),
+				keyTok: key,
+			}
+			var close *tokInfo
+			sec.Body, sec.Trailing, close = p.astBody(p.sectionEnd)
+			if close == nil {
+				return nil
+			}
+			sec.Close = close.Position()
+			sec.Stop = close.EndPosition()
+			if end := p.accept(p.stmtEnd); end != nil {
+				sec.Stop = end.EndPosition()
+			}
+			return sec
+		}
+		if p.peek(p.stmtEnd) == nil {
+			tok, ok := p.expect(tokValue, "value")
+			if !ok {
+				p.recover(tok)
+				return nil
+			}
+			args = append(args, newValue(tok))
+			if p.accept(tokComma) != nil {
+				p.accept(tokNL)
+			}
+			continue
+		}
+		end := p.nextToken()
+		return &Statement{
+			Key: string(key.Value),
+			KeyPos: key.Position(),
+			Values: args,
+			Stop: end.EndPosition(),
+			keyTok: key,
+			endTok: end,
+		}
+	}
+}
+
+//
+//	Parse a file in ParserDiablo format. All lines are read as
+//	statements, and when "end" is seen the statements that belong
+//	to the section are moved into it.
+//
+func (p *Parser) astLines() (nodes []Node, trailing []*Comment) {
+	var prev Node
+	for {
+		p.peekToken()
+		comments := p.astComments(prev)
+		if p.accept(tokEOF) != nil {
+			trailing = append(trailing, comments...)
+			return
+		}
+		if p.accept(tokNL) != nil {
+			trailing = append(trailing, comments...)
+			continue
+		}
+		if end := p.accept(tokEnd); end != nil {
+			sec := p.astEnd(nodes, end)
+			if sec == nil {
+				p.recover(nil)
+				continue
+			}
+			sec.Trailing = append(trailing, comments...)
+			trailing = nil
+			if nl := p.accept(tokNL|tokEOF); nl != nil {
+				sec.Stop = nl.EndPosition()
+			} else {
+				nl, _ = p.expect(tokNL, "newline")
+				p.recover(nl)
+			}
+			// the section replaces its header and body.
+			n := len(nodes) - len(sec.Body) - 1
+			nodes = append(nodes[:n], sec)
+			prev = sec
+			continue
+		}
+		key, ok := p.expect(tokIdent, "identifier")
+		if !ok {
+			p.recover(key)
+			if p.errCount > p.maxErrors {
+				return
+			}
+			continue
+		}
+		st := &Statement{
+			Key: string(key.Value),
+			KeyPos: key.Position(),
+			Comments: append(trailing, comments...),
+			keyTok: key,
+		}
+		trailing = nil
+		for p.peek(tokNL|tokEOF) == nil {
+			tok, ok := p.expect(tokValue, "value")
+			if !ok {
+				p.recover(tok)
+				st = nil
+				break
+			}
+			st.Values = append(st.Values, newValue(tok))
+			if p.accept(tokComma) != nil {
+				p.accept(tokNL)
+			}
+		}
+		if st == nil {
+			continue
+		}
+		nl := p.nextToken()
+		st.Stop = nl.EndPosition()
+		st.endTok = nl
+		nodes = append(nodes, st)
+		prev = st
+	}
+}
+
+//
+//	Find the header of the section that is closed by "end".
+//
+func (p *Parser) astEnd(nodes []Node, end *tokInfo) (sec *Section) {
+	col := end.Pos.Column
+	k := -1
+	for i := len(nodes) - 1; i >= 0; i-- {
+		c := nodes[i].Pos().Column
+		if c < col {
+			break
+		}
+		st, ok := nodes[i].(*Statement)
+		if !ok {
+			if c == col {
+				break
+			}
+			continue
+		}
+		if c == col && len(st.Values) <= 1 {
+			k = i
+			if i + 1 < len(nodes) && nodes[i + 1].Pos().Column > col {
+				break
+			}
+		}
+	}
+	if k < 0 {
+		p.error(end, "\"end\" without section")
+		return
+	}
+	hdr := nodes[k].(*Statement)
+	sec = &Section{
+		Key: hdr.Key,
+		KeyPos: hdr.KeyPos,
+		Args: hdr.Values,
+		Body: append([]Node{}, nodes[k + 1:]...),
+		Open: hdr.endTok.Position(),
+		Close: end.Position(),
+		Comments: hdr.Comments,
+		LineComment: hdr.LineComment,
+		Stop: end.EndPosition(),
+		keyTok: hdr.keyTok,
+	}
+	return
+}
+
+// Decode puts the contents of a node into obj, which must be a
+// pointer to a struct, with the same rules as Parser.Parse, except
+// that include statements are not read: they are an error. Use
+// Parse for files with includes.
+//
+// For a *Document the whole document is decoded. For a *Section,
+// obj is the struct of the section: its statements are decoded,
+// and its name is put in Name_. A *Statement is decoded as if it
+// was a statement at the top of obj.
+//
+// Decode uses the default settings. To set a resolver, converters
+// or variables, use the Decode method of a Parser.
+func Decode(n interface{}, obj interface{}) (err error) {
+	return (&Parser{ maxErrors: 10 }).Decode(n, obj)
+}
+
+// Decode is like the Decode function, but uses the settings of p:
+// SetResolver, SetNoResolve, RegisterConverter, SetVar, AllowEnv and
+// SetRecordSources. Overrides are not applied. p can be the parser
+// that returned the tree with ParseAST, but not one that was used
+// for Parse.
+func (p *Parser) Decode(n interface{}, obj interface{}) (err error) {
+	sw := newStructWriter(obj)
+	sw.conv = &p.conv
+	switch n := n.(type) {
+		case *Document:
+			p.decodeNodes(sw, n.Body)
+		case *Section:
+			if v := sw.stru.FieldByName("Name_"); v.IsValid() {
+				v.SetString(n.Name())
+			}
+			p.decodeNodes(sw, n.Body)
+		case *Statement:
+			p.decodeNodes(sw, []Node{ n })
+	}
+	if p.errCount <= p.maxErrors {
+		p.finish(sw.stru, "")
+	}
+	if p.errCount > 0 {
+		err = &p.errors
+	}
+	return
+}
+
+func (p *Parser) decodeNodes(sw *structWriter, nodes []Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+			case *Statement:
+				p.decodeStmt(sw, n.keyTok, n.Values, nil)
+			case *Section:
+				p.decodeStmt(sw, n.keyTok, n.Args, n)
+		}
+		if p.errCount > p.maxErrors {
+			return
+		}
+	}
+}
+
+//
+//	Decode a statement or section into the struct.
+//
+func (p *Parser) decodeStmt(sw *structWriter, key *tokInfo, args []*Value, sec *Section) {
+
+	if string(key.Value) == "include" {
+		p.report(key, CodeInclude, "include is not supported by Decode, use Parse", nil)
+		return
+	}
+	if string(key.Value) == "set" && sec == nil && p.expandVars {
+		if len(args) != 2 || !args[0].Class.Has(ClassIdent) {
+			p.error(key, "usage: set name value")
+			return
+		}
+		p.define(args[0].tok, args[1].tok, args[1].Raw)
+		return
+	}
+
+	field, err := sw.structField(string(key.Value))
+	if err != nil {
+		p.errorErr(key, CodeUnknownField, err)
+		return
+	}
+	p.markSeen(sw, field, key)
+
+	if field.IsStruct() {
+		var name string
+		if field.HasName() {
+			if len(args) == 0 {
+				p.error(key, "section-name expected")
+				return
+			}
+			s, ok := p.expand(args[0].tok, args[0].Raw)
+			if !ok {
+				return
+			}
+			if name, err = unquote(s); err != nil {
+				name = s
+			}
+			args = args[1:]
+		}
+		if err := field.Section(name); err != nil {
+			p.errorErr(key, CodeSection, err)
+			return
+		}
+		p.state(field.elemPath, key)
+		sub := field.writer()
+		p.pushScope()
+		switch {
+			case len(args) > 0 && !args[0].Class.Has(ClassIdent):
+				p.error(args[0].tok, "parse error, expected identifier")
+			case len(args) > 0:
+				// flattened section
+				p.decodeStmt(sub, args[0].tok, args[1:], sec)
+			case sec != nil:
+				p.decodeNodes(sub, sec.Body)
+			default:
+				p.error(key, "section has no contents")
+		}
+		p.popScope()
+		p.validateSection(field, key)
+		field.Done()
+		return
+	}
+
+	if sec != nil {
+		p.error(key, "not a section")
+		return
+	}
+	if field.IsBool() && len(args) == 0 {
+		field.Set("true")
+		return
+	}
+	if len(args) == 0 {
+		p.error(key, "value expected")
+		return
+	}
+	if len(args) > 1 && !field.IsSlice() {
+		p.error(args[1].tok, "field takes only one value")
+		return
+	}
+	for _, v := range args {
+		if s, ok := p.expand(v.tok, v.Raw); ok {
+			p.setField(field, v.tok, s)
+		}
+	}
+}
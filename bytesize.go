@@ -0,0 +1,144 @@
+//
+//	Sizes in bytes: 512MB, 64KiB, 1.5GiB.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A ByteSize is a number of bytes. In a configuration file it is written
+// as a number with an optional unit: B, the SI units kB, MB, GB, TB, PB
+// and EB (powers of 1000), or the IEC units KiB, MiB, GiB, TiB, PiB and
+// EiB (powers of 1024). A fraction is allowed if the result is a whole
+// number of bytes, so 1.5KiB is 1536. Units that are ambiguous (k, M,
+// KB) or that could mean bits (Mb) are rejected. A hexadecimal number
+// has no unit: 0x1B is 27 bytes, and 0x10KiB is an error.
+type ByteSize uint64
+
+var sizeUnits = []struct {
+	unit	string
+	mult	uint64
+}{
+	{ "KiB", 1 << 10 },
+	{ "MiB", 1 << 20 },
+	{ "GiB", 1 << 30 },
+	{ "TiB", 1 << 40 },
+	{ "PiB", 1 << 50 },
+	{ "EiB", 1 << 60 },
+	{ "kB", 1e3 },
+	{ "MB", 1e6 },
+	{ "GB", 1e9 },
+	{ "TB", 1e12 },
+	{ "PB", 1e15 },
+	{ "EB", 1e18 },
+	{ "B", 1 },
+}
+
+// Parse a size.
+func ParseByteSize(s string) (b ByteSize, err error) {
+	orig := s
+	if s, err = unquote(s); err != nil {
+		return
+	}
+	v := strings.TrimSpace(s)
+	mult := uint64(1)
+	hex := strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X")
+	if hex {
+		// B and E are hex digits, so a hex number has no unit:
+		// 0x1B is 27 bytes.
+		if strings.TrimLeft(v[2:], "0123456789abcdefABCDEF_") != "" {
+			return 0, fmt.Errorf("invalid size %s: a hexadecimal size cannot have a unit", orig)
+		}
+	} else {
+		for _, u := range sizeUnits {
+			if strings.HasSuffix(v, u.unit) {
+				v = strings.TrimSpace(v[:len(v) - len(u.unit)])
+				mult = u.mult
+				break
+			}
+		}
+	}
+	if v == "" {
+		return 0, fmt.Errorf("invalid size %s", orig)
+	}
+	if c := v[len(v) - 1]; isLetter(c) && !hex {
+		return 0, fmt.Errorf("invalid size %s: unknown or ambiguous unit " +
+			"(use B, kB, MB, GB, TB, PB, EB or KiB, MiB, GiB, TiB, PiB, EiB)",
+			orig)
+	}
+
+	r, err := parseNumber("ParseByteSize", v)
+	if err != nil {
+		return
+	}
+	r.Mul(r, new(big.Rat).SetUint64(mult))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("invalid size %s: not a whole number of bytes", orig)
+	}
+	n := r.Num()
+	if !n.IsUint64() {
+		err = &strconv.NumError{ Func: "ParseByteSize", Num: orig, Err: strconv.ErrRange }
+		return
+	}
+	b = ByteSize(n.Uint64())
+	return
+}
+
+// Implements encoding.TextUnmarshaler.
+func (b *ByteSize) UnmarshalText(text []byte) (err error) {
+	*b, err = ParseByteSize(string(text))
+	return
+}
+
+// Implements encoding.TextMarshaler.
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// Returns the size in the largest unit that gives a whole number:
+// 1536 is "1536B", 1048576 is "1MiB" and 512000000 is "512MB".
+func (b ByteSize) String() string {
+	unit, mult := "B", uint64(1)
+	for _, u := range sizeUnits {
+		if b != 0 && uint64(b) % u.mult == 0 && u.mult > mult {
+			unit, mult = u.unit, u.mult
+		}
+	}
+	return strconv.FormatUint(uint64(b) / mult, 10) + unit
+}
+
+//
+//	Set an integer field with the "bytesize" tag.
+//
+func setByteSize(val reflect.Value, s string) (err error) {
+	b, err := ParseByteSize(s)
+	if err != nil {
+		return
+	}
+	bits := val.Type().Bits()
+	switch val.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16,
+		     reflect.Int32, reflect.Int64:
+			if uint64(b) >= 1 << (bits - 1) {
+				break
+			}
+			val.SetInt(int64(b))
+			return
+		case reflect.Uint, reflect.Uint8, reflect.Uint16,
+		     reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if bits < 64 && uint64(b) >= 1 << bits {
+				break
+			}
+			val.SetUint(uint64(b))
+			return
+		default:
+			return fmt.Errorf("bytesize: %s is not an integer type", val.Type())
+	}
+	return &strconv.NumError{ Func: "ParseByteSize", Num: s, Err: strconv.ErrRange }
+}
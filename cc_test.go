@@ -6,9 +6,29 @@
 package curlyconf
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
+	"math/rand"
 	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
 )
 
 type Attr int
@@ -37,6 +57,40 @@ func (a *Attr) UnmarshalText(s []byte) (err error) {
 	return
 }
 
+// TextAttr is an Attr that can also be written by Marshal, and
+// returns a sentinel error.
+type TextAttr int
+
+type TextFile struct {
+	Name_	string
+	Dir	string	`cc:"folder,directory"`
+	Attr	[]TextAttr
+	Ptr	*string
+}
+
+type TextMain struct {
+	File		[]TextFile
+	Net		[]net.IPNet
+}
+
+var errUnknownAttr = errors.New("unknown attr value")
+
+func (a TextAttr) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("v%d", a)), nil
+}
+
+func (a *TextAttr) UnmarshalText(s []byte) (err error) {
+	switch string(s) {
+		case "v1":
+			*a = 1
+		case "v2":
+			*a = 2
+		default:
+			err = errUnknownAttr
+	}
+	return
+}
+
 var conf1 string = `
 file file1 {
 	dir	/var/tmp;
@@ -119,3 +173,2204 @@ func TestConf2(t *testing.T) {
 	testconf(t, conf2, ParserDiablo)
 }
 
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.conf": "include \"conf.d/*.conf\";\nnet 194.109.6.66/32;\n",
+		"conf.d/a.conf": "file file1 {\n\tinclude \"../dir.inc\";\n}\n",
+		"conf.d/b.conf": "file file2 dir /tmp;\n",
+		"dir.inc": "dir /var/tmp;\n",
+	})
+	var top Main
+	p, err := NewParser(filepath.Join(dir, "main.conf"), ParserSemi)
+	if err == nil {
+		err = p.Parse(&top)
+	}
+	if err != nil {
+		t.Fatal(err.(*ParseError).LongError())
+	}
+	if len(top.File) != 2 || top.File[0].Dir != "/var/tmp" ||
+	   top.File[1].Dir != "/tmp" || len(top.Net) != 1 {
+		t.Errorf("unexpected result %+v", top)
+	}
+	if len(p.Files()) != 4 {
+		t.Errorf("expected 4 files read, got %v", p.Files())
+	}
+}
+
+type IncludeConf struct {
+	Include	string
+	Headers	map[string]string
+}
+
+func TestIncludeKeyword(t *testing.T) {
+	// include is a keyword, also where a field would match.
+	dir := writeFiles(t, map[string]string{
+		"main.conf": "headers {\n\tinclude \"h.inc\";\n}\ninclude \"i.inc\";\n",
+		"h.inc": "x-a 1;\n",
+		"i.inc": "headers x-b 2;\n",
+	})
+	var c IncludeConf
+	p, err := NewParser(filepath.Join(dir, "main.conf"), ParserSemi)
+	if err == nil {
+		err = p.Parse(&c)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IncludeConf{ Headers: map[string]string{ "x-a": "1", "x-b": "2" } }
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.conf": "include \"a.conf\";\n",
+		"a.conf": "\ninclude \"b.conf\";\n",
+		"b.conf": "file x { nodir 1; }\ninclude \"a.conf\";\n",
+	})
+	var top Main
+	p, err := NewParser(filepath.Join(dir, "main.conf"), ParserSemi)
+	if err == nil {
+		err = p.Parse(&top)
+	}
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	pe := err.(*ParseError)
+	if !strings.HasPrefix(pe.Detail[0], "In file included from ") ||
+	   !strings.HasSuffix(pe.Detail[0], "a.conf:2,") ||
+	   !strings.HasSuffix(pe.Detail[1], "main.conf:1:") {
+		t.Errorf("unexpected include chain:\n%s", pe.LongError())
+	}
+	if !strings.Contains(pe.Error(), "b.conf:1.10: section file: unknown field nodir") ||
+	   !strings.Contains(pe.LongError(), "include loop") {
+		t.Errorf("unexpected error:\n%s", pe.LongError())
+	}
+}
+
+func TestIncludeEOF(t *testing.T) {
+	// a block or statement cannot continue after the end of
+	// an included file.
+	for _, tc := range []struct{ main, inc, err string }{
+		{ "include \"x.inc\";\n\tdir /tmp;\n}\n", "file f2 {\n",
+		  "x.inc:2.1: section file: unexpected end-of-file" },
+		{ "include \"x.inc\";\n;\n", "file f1 dir /tmp",
+		  "x.inc:1.17: section file: unexpected end-of-file" },
+	} {
+		dir := writeFiles(t, map[string]string{
+			"main.conf": tc.main,
+			"x.inc": tc.inc,
+		})
+		var top Main
+		p, err := NewParser(filepath.Join(dir, "main.conf"), ParserSemi)
+		if err == nil {
+			err = p.Parse(&top)
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected %s, got %v", tc.inc, tc.err, err)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	var top TextMain
+	p, err := NewParserFromString(conf1, ParserSemi)
+	if err == nil {
+		err = p.Parse(&top)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, how := range []int{ ParserSemi, ParserNL, ParserDiablo } {
+		data, err := Marshal(&top, how)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var top2 TextMain
+		p, err := NewParserFromString(string(data), how)
+		if err == nil {
+			err = p.Parse(&top2)
+		}
+		if err != nil {
+			t.Fatalf("%s\n%s", data, err.(*ParseError).LongError())
+		}
+		if !reflect.DeepEqual(top, top2) {
+			t.Errorf("type %d: read back differs:\n%s", how, data)
+		}
+	}
+}
+
+type ZeroConf struct {
+	S	[]string
+	D	string		`cc:"default=x"`
+	N	int		`cc:"default=5"`
+	M	map[string]int
+	E	map[string]string
+}
+
+func TestMarshalZero(t *testing.T) {
+	// Empty strings and zero values that are not the default
+	// must read back as they were.
+	want := ZeroConf{
+		S: []string{ "a", "" },
+		M: map[string]int{ "x": 0, "y": 1 },
+		E: map[string]string{ "e": "" },
+	}
+	for _, how := range []int{ ParserSemi, ParserNL, ParserDiablo } {
+		data, err := Marshal(&want, how)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c ZeroConf
+		p, _ := NewParserFromString(string(data), how)
+		if err := p.Parse(&c); err != nil || !reflect.DeepEqual(c, want) {
+			t.Errorf("%d: read back %+v, %v\n%s", how, c, err, data)
+		}
+	}
+}
+
+type KeywordConf struct {
+	Include	string		`cc:"include,inc"`
+	Set	[]string	`cc:"set,setting"`
+	Inf	float64
+	NegInf	float32
+	Addr	net.IPAddr
+	Listen	net.TCPAddr
+	Net	net.IPNet
+	Dur	time.Duration
+	End	string
+}
+
+type BadKeyword struct {
+	Include	string
+}
+
+func TestMarshalText(t *testing.T) {
+	// every value is written so that it reads back.
+	_, ipnet, _ := net.ParseCIDR("10.1.0.0/16")
+	want := KeywordConf{
+		Include: "x",
+		Set: []string{ "a", "${b}" },
+		Inf: math.Inf(1),
+		NegInf: float32(math.Inf(-1)),
+		Addr: net.IPAddr{ IP: net.ParseIP("fe80::1"), Zone: "eth0" },
+		Listen: net.TCPAddr{ IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 80 },
+		Net: *ipnet,
+		Dur: 90 * time.Minute,
+		End: "end",
+	}
+	for _, expand := range []bool{ false, true } {
+		for _, how := range []int{ ParserSemi, ParserNL, ParserDiablo } {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf, how)
+			enc.SetExpandVars(expand)
+			if err := enc.Encode(&want); err != nil {
+				t.Fatal(err)
+			}
+			var c KeywordConf
+			p, _ := NewParserFromString(buf.String(), how)
+			p.SetExpandVars(expand)
+			if err := p.Parse(&c); err != nil || !reflect.DeepEqual(c, want) {
+				t.Errorf("%d/%v: read back %+v, %v\n%s", how, expand, c, err, buf.String())
+			}
+		}
+	}
+
+	// a keyword without an alias cannot be written.
+	if _, err := Marshal(&BadKeyword{ Include: "x" }, ParserSemi); err == nil {
+		t.Errorf("field include: expected an error")
+	}
+	if _, err := Marshal(&IncludeConf{ Headers: map[string]string{ "include": "x" } },
+				ParserSemi); err == nil {
+		t.Errorf("key include: expected an error")
+	}
+}
+
+func TestAST(t *testing.T) {
+	for _, tc := range []struct{ data string; how, n int }{
+		{ conf1, ParserSemi, 2 },
+		{ conf2, ParserDiablo, 3 },
+	} {
+		p, err := NewParserFromString(tc.data, tc.how)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := p.ParseAST()
+		if err != nil {
+			t.Fatal(err.(*ParseError).LongError())
+		}
+		sec, ok := doc.Body[0].(*Section)
+		if !ok || sec.Key != "file" || sec.Name() != "file1" ||
+		   len(sec.Body) != tc.n || sec.KeyPos.Line != 2 {
+			t.Errorf("type %d: unexpected first node %+v", tc.how, doc.Body[0])
+		}
+		var top, want Main
+		if err := Decode(doc, &top); err != nil {
+			t.Fatal(err.(*ParseError).LongError())
+		}
+		p, _ = NewParserFromString(tc.data, tc.how)
+		p.Parse(&want)
+		if !reflect.DeepEqual(top, want) {
+			t.Errorf("type %d: Decode differs from Parse: %+v", tc.how, top)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	conf := "include \"x.conf\";\nhost web \"x\";\nhost www address 10.0.0.1;\n"
+	p, _ := NewParserFromString(conf, ParserSemi)
+	doc, err := p.ParseAST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var top MapMain
+	err = Decode(doc, &top)
+	pe, ok := err.(*ParseError)
+	if !ok || len(pe.Diagnostics) != 2 || pe.Diagnostics[0].Code != CodeInclude ||
+	   !strings.Contains(pe.Diagnostics[0].Message, "not supported") {
+		t.Fatalf("expected an include error, got %v", err)
+	}
+	// the section with the error is still finished.
+	if _, ok := top.Host["web"]; !ok || top.Host["www"].Address != "10.0.0.1" {
+		t.Errorf("got %+v", top.Host)
+	}
+}
+
+func TestASTComments(t *testing.T) {
+	conf := "# people\nperson snoopy { # dog\n\tfullname \"Snoopy\"; // name\n}\n# the end\n"
+	p, _ := NewParserFromString(conf, ParserSemi)
+	doc, err := p.ParseAST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec := doc.Body[0].(*Section)
+	st := sec.Body[0].(*Statement)
+	if len(sec.Comments) != 1 || sec.Comments[0].Text != "# people" ||
+	   st.Comments[0].Text != "# dog" || st.LineComment.Text != "// name" ||
+	   st.Values[0].Text != "Snoopy" || !st.Values[0].Class.Has(ClassString) ||
+	   len(doc.Trailing) != 1 {
+		t.Errorf("comments not attached as expected")
+	}
+}
+
+type CommentConf struct {
+	Port	int
+	Name	string
+	Server	[]LayerServer
+}
+
+func TestCommentNL(t *testing.T) {
+	// A comment ends at the newline, it does not eat it.
+	want := CommentConf{ Port: 80, Name: "x",
+		Server: []LayerServer{ { Name_: "a", Address: "1" } } }
+	for _, tc := range []struct{ how int; conf string }{
+		{ ParserNL, "port 80 # c\nname x\n# whole line\nserver a { # c\n\taddress 1 // c\n}\n" },
+		{ ParserDiablo, "port 80 # c\n# whole line\nname x\nserver a # c\n\taddress 1 # c\nend # c\n" },
+		{ ParserSemi, "port 80; # c\nname x; # c\nserver a { address 1; } # c" },
+	} {
+		p, _ := NewParserFromString(tc.conf, tc.how)
+		var c CommentConf
+		if err := p.Parse(&c); err != nil {
+			t.Errorf("%d: %s", tc.how, err)
+		} else if !reflect.DeepEqual(c, want) {
+			t.Errorf("%d: got %+v, want %+v", tc.how, c, want)
+		}
+	}
+}
+
+func TestEditor(t *testing.T) {
+	for _, tc := range []struct{ how int; in, out string }{
+		{ ParserSemi,
+		  "# people\nperson charlie {\n\tfullname \"Charlie Brown\"; # full\n\taddress 192.168.1.1;\n}\n" +
+		  "person snoopy {\n    fullname \"Snoopy\";\n}\nperson snoopy address 5.6.7.8; # dog\n",
+		  "# people\nperson charlie {\n\taddress 10.1.1.1;\n}\n" +
+		  "person snoopy {\n    fullname \"Snoopy\";\n    nick snoop;\n}\nperson snoopy address 10.0.0.1; # dog\n" +
+		  "person lucy fullname \"Lucy van Pelt\";\n" },
+		{ ParserNL,
+		  "person charlie {\n\tfullname \"Charlie Brown\"\n\taddress 192.168.1.1\n}\n" +
+		  "person snoopy {\n}\nperson snoopy address 5.6.7.8\n",
+		  "person charlie {\n\taddress 10.1.1.1\n}\n" +
+		  "person snoopy {\n\tnick snoop\n}\nperson snoopy address 10.0.0.1\n" +
+		  "person lucy fullname \"Lucy van Pelt\"\n" },
+		{ ParserDiablo,
+		  "person charlie\n  fullname \"Charlie Brown\"\n  address 192.168.1.1\nend\n" +
+		  "person snoopy\nend\nperson snoopy address 5.6.7.8\n",
+		  "person charlie\n  address 10.1.1.1\nend\n" +
+		  "person snoopy\n\tnick snoop\nend\nperson snoopy address 10.0.0.1\n" +
+		  "person lucy fullname \"Lucy van Pelt\"\n" },
+	} {
+		e, err := NewEditorFromString(tc.in, tc.how)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []func() error{
+			func() error { return e.Set("person snoopy address", "10.0.0.1") },
+			func() error { return e.Set("person charlie address", "10.1.1.1") },
+			func() error { return e.Add("person snoopy nick", "snoop") },
+			func() error { return e.Delete("person charlie fullname") },
+			func() error { return e.Set("person lucy fullname", "Lucy van Pelt") },
+		} {
+			if err := f(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(e.Bytes()) != tc.out {
+			t.Errorf("type %d: unexpected result:\n%s", tc.how, e.Bytes())
+		}
+	}
+}
+
+func TestEditorReparse(t *testing.T) {
+	// Set replaces all occurrences, so that the file reads back
+	// with the new values.
+	for _, tc := range []struct{ how int; in string }{
+		{ ParserSemi, "host www {\n\talias a;\n\talias b; # b\n}\nhost www alias c;\n" },
+		{ ParserNL, "host www {\n\talias a\n\talias b # b\n}\nhost www alias c\n" },
+		{ ParserDiablo, "host www\n  alias a\n  alias b # b\nend\nhost www alias c\n" },
+	} {
+		e, _ := NewEditorFromString(tc.in, tc.how)
+		if err := e.Set("host www alias", "x", "y"); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.AddSection("host lucy"); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Add("host lucy address", "10.0.0.9"); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.AddSection("host lucy"); err == nil {
+			t.Errorf("%d: AddSection of an existing section succeeded", tc.how)
+		}
+		var top MapMain
+		p, _ := NewParserFromString(string(e.Bytes()), tc.how)
+		if err := p.Parse(&top); err != nil {
+			t.Fatalf("%d: %s\n%s", tc.how, err, e.Bytes())
+		}
+		want := map[string]Host{
+			"www": { Name_: "www", Alias: []string{ "x", "y" } },
+			"lucy": { Name_: "lucy", Address: "10.0.0.9" },
+		}
+		if !reflect.DeepEqual(top.Host, want) {
+			t.Errorf("%d: got %+v\n%s", tc.how, top.Host, e.Bytes())
+		}
+	}
+
+	// An empty section after a statement looks like a section
+	// with that statement as header in ParserDiablo.
+	e, _ := NewEditorFromString("verbose yes\n", ParserDiablo)
+	if err := e.AddSection("host lucy"); err == nil {
+		t.Errorf("expected an error, got\n%s", e.Bytes())
+	}
+	if string(e.Bytes()) != "verbose yes\n" {
+		t.Errorf("file changed after error:\n%s", e.Bytes())
+	}
+}
+
+func TestEditorSection(t *testing.T) {
+	// Set on a section is an error, also if it is flattened.
+	for _, in := range []string{
+		"person charlie address 5.6.7.8;\n",
+		"person charlie { address 5.6.7.8; }\n",
+	} {
+		e, _ := NewEditorFromString(in, ParserSemi)
+		for _, path := range []string{ "person", "person charlie" } {
+			if err := e.Set(path, "x"); err == nil {
+				t.Errorf("%q: Set(%q) succeeded:\n%s", in, path, e.Bytes())
+			}
+		}
+		if string(e.Bytes()) != in {
+			t.Errorf("file changed after error:\n%s", e.Bytes())
+		}
+	}
+
+	// Adding to a block on one line.
+	for _, tc := range []struct{ how int; in, out string }{
+		{ ParserSemi, "person snoopy { address 1.2.3.4; }\n",
+		  "person snoopy { address 1.2.3.4;\n\tport 80;\n}\n" },
+		{ ParserSemi, "person snoopy {\n\taddress 1.2.3.4; }\n",
+		  "person snoopy {\n\taddress 1.2.3.4;\n\tport 80;\n}\n" },
+	} {
+		e, err := NewEditorFromString(tc.in, tc.how)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Set("person snoopy port", "80"); err != nil {
+			t.Fatal(err)
+		}
+		if string(e.Bytes()) != tc.out {
+			t.Errorf("%q: unexpected result:\n%s", tc.in, e.Bytes())
+		}
+	}
+
+	// WriteFile keeps the mode of the file.
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.conf")
+	os.WriteFile(file, []byte("port 1;\n"), 0600)
+	e, err := NewEditor(file, ParserSemi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Set("port", "2")
+	if err = e.WriteFile(file); err == nil {
+		err = e.WriteFile(filepath.Join(dir, "b.conf"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{ "a.conf", "b.conf" } {
+		fi, _ := os.Stat(filepath.Join(dir, f))
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: mode %o", f, fi.Mode().Perm())
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var top TextMain
+	p, _ := NewParserFromString("file f1 {\n\tattr v1, v3;\n}\n", ParserSemi)
+	err := p.Parse(&top)
+	if !errors.Is(err, errUnknownAttr) {
+		t.Fatalf("expected errUnknownAttr, got %v", err)
+	}
+	d := err.(*ParseError).Diagnostics[0]
+	if d.Span.Start.Line != 2 || d.Span.Start.Column != 11 ||
+	   d.Span.End.Column != 13 || d.Token != "v3" ||
+	   d.Code != CodeValue || d.Severity != SeverityError {
+		t.Errorf("unexpected diagnostic %+v", d)
+	}
+	if err.Error() != "[internal]:2.11: section file: unknown attr value" {
+		t.Errorf("unexpected error %q", err.Error())
+	}
+
+	_, err = NewParser("/nonexistent/file.cfg", ParserSemi)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+type Host struct {
+	Name_	string
+	Address	string
+	Alias	[]string
+}
+
+type MapMain struct {
+	Host	map[string]Host
+	PHost	map[string]*Host
+	Headers	map[string]string
+	Limits	map[string][]int
+}
+
+func TestMap(t *testing.T) {
+	conf := `
+host www { address 10.0.0.1; }
+host www alias web, w3;
+host "mail" address 10.0.0.2;
+phost ns1 address 10.0.0.3;
+phost ns1 alias dns;
+headers {
+	X-Forwarded-For "yes";
+	Via proxy1;
+}
+headers Via proxy2;
+limits { cpu 1, 2; }
+`
+	var top MapMain
+	p, err := NewParserFromString(conf, ParserSemi)
+	if err == nil {
+		err = p.Parse(&top)
+	}
+	if err != nil {
+		t.Fatal(err.(*ParseError).LongError())
+	}
+	want := MapMain{
+		Host: map[string]Host{
+			"www": { Name_: "www", Address: "10.0.0.1", Alias: []string{ "web", "w3" } },
+			"mail": { Name_: "mail", Address: "10.0.0.2" },
+		},
+		PHost: map[string]*Host{
+			"ns1": { Name_: "ns1", Address: "10.0.0.3", Alias: []string{ "dns" } },
+		},
+		Headers: map[string]string{ "X-Forwarded-For": "yes", "Via": "proxy2" },
+		Limits: map[string][]int{ "cpu": { 1, 2 } },
+	}
+	if !reflect.DeepEqual(top, want) {
+		t.Errorf("unexpected result %+v", top)
+	}
+
+	data, err := Marshal(&top, ParserNL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var top2 MapMain
+	p, _ = NewParserFromString(string(data), ParserNL)
+	if err = p.Parse(&top2); err != nil || !reflect.DeepEqual(top, top2) {
+		t.Errorf("read back differs: %v\n%s", err, data)
+	}
+}
+
+type Server struct {
+	Name_	string
+	Port	int		`cc:"port,listen,required"`
+	Timeout	time.Duration	`cc:"default=1d12h"`
+	Backlog	uint64		`cc:"default=4k"`
+	Verbose	bool		`cc:"default=yes"`
+}
+
+type ServerMain struct {
+	Server	[]Server	`cc:"required"`
+	Admin	struct {
+		Email	string	`cc:"default=root@localhost"`
+	}
+}
+
+func TestRequiredDefault(t *testing.T) {
+	conf := `
+server www {
+	listen 80;
+}
+server www timeout 10s;
+server www verbose off;
+server mail {
+}
+`
+	var top ServerMain
+	p, _ := NewParserFromString(conf, ParserSemi)
+	err := p.Parse(&top)
+	if err == nil {
+		t.Fatal("expected error for missing port")
+	}
+	d := err.(*ParseError).Diagnostics
+	if len(d) != 1 || d[0].Code != CodeRequired || d[0].Span.Start.Line != 7 ||
+	   d[0].Message != "section server: missing required field port" {
+		t.Errorf("unexpected error %s", err.(*ParseError).LongError())
+	}
+	www := top.Server[0]
+	if www.Port != 80 || www.Timeout != 10 * time.Second ||
+	   www.Backlog != 4000 || www.Verbose {
+		t.Errorf("unexpected server www %+v", www)
+	}
+	if top.Server[1].Timeout != 36 * time.Hour || !top.Server[1].Verbose ||
+	   top.Admin.Email != "root@localhost" {
+		t.Errorf("defaults not set: %+v", top)
+	}
+
+	var top2 ServerMain
+	p, _ = NewParserFromString("", ParserSemi)
+	err = p.Parse(&top2)
+	if err == nil || err.Error() != "missing required field server" {
+		t.Errorf("expected missing server, got %v", err)
+	}
+}
+
+type AliasDefault struct {
+	Host	string	`cc:"host,name"`
+	Name	string	`cc:"default=www"`
+}
+
+func TestAliasDefault(t *testing.T) {
+	// the default of Name is not stored in Host, which has
+	// "name" as alias.
+	var c AliasDefault
+	p, _ := NewParserFromString("host example.com;\n", ParserSemi)
+	if err := p.Parse(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "example.com" || c.Name != "www" {
+		t.Errorf("unexpected result %+v", c)
+	}
+}
+
+type Limits struct {
+	Port	int		`cc:"port,min=1,max=65535"`
+	Timeout	time.Duration	`cc:"timeout,max=1m"`
+	Mode	string		`cc:"mode,oneof=fast|slow"`
+	User	string		`cc:"user,minlen=2,maxlen=8,match=^[a-z]+$"`
+	Peer	[]string	`cc:"peer,minitems=1,maxitems=2"`
+}
+
+func TestConstraints(t *testing.T) {
+	conf := `
+port 65535;
+timeout 30s;
+mode fast;
+user bob;
+peer a, b;
+`
+	var l Limits
+	p, _ := NewParserFromString(conf, ParserSemi)
+	if err := p.Parse(&l); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	tests := []struct {
+		conf	string
+		line	int
+		col	int
+		msg	string
+	}{
+		{ "port 0; peer a;", 1, 6, "value 0 is less than the minimum 1" },
+		{ "peer a;\nport 70000;", 2, 6, "value 70000 is more than the maximum 65535" },
+		{ "peer a; timeout 2m;", 1, 17, "value 2m0s is more than the maximum 1m" },
+		{ "peer a; mode medium;", 1, 14, "value medium must be one of fast, slow" },
+		{ "peer a; user b;", 1, 14, "value b is shorter than 2 characters" },
+		{ "peer a; user Bob;", 1, 14, "value Bob does not match ^[a-z]+$" },
+		{ "peer a, b, c;", 1, 1, "field peer has 3 values, maximum is 2" },
+		{ "port 1;", 0, 0, "field peer has 0 values, minimum is 1" },
+	}
+	for _, tc := range tests {
+		var l Limits
+		p, _ := NewParserFromString(tc.conf, ParserSemi)
+		err := p.Parse(&l)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 {
+			t.Errorf("%q: expected one error, got %v", tc.conf, err)
+			continue
+		}
+		d := pe.Diagnostics[0]
+		if d.Code != CodeConstraint || d.Message != tc.msg ||
+		   d.Span.Start.Line != tc.line || d.Span.Start.Column != tc.col {
+			t.Errorf("%q: unexpected error %s (%s)", tc.conf, d, d.Code)
+		}
+	}
+}
+
+type BadBound struct {
+	Name	string	`cc:"name,min=1"`
+	Port	int	`cc:"port,max=lots"`
+}
+
+func TestConstraintCost(t *testing.T) {
+	// The bounds are parsed once, and a field without constraints
+	// is not looked at.
+	tp := reflect.TypeOf(Limits{})
+	port := parseTag(tp.Field(0))
+	if parseTag(tp.Field(0)) != port {
+		t.Errorf("tag is parsed again")
+	}
+	v := reflect.ValueOf(&Limits{ Port: 80 }).Elem()
+	plain := parseTag(reflect.TypeOf(Host{}).Field(1))
+	for _, tc := range []struct{ tag *fieldTag; v reflect.Value }{
+		{ port, v.Field(0) },
+		{ parseTag(tp.Field(1)), v.Field(1) },
+		{ plain, v.Field(3) },
+	} {
+		if n := testing.AllocsPerRun(100, func() { tc.tag.check(tc.v) }); n != 0 {
+			t.Errorf("%s: check allocates %v times", tc.v.Type(), n)
+		}
+	}
+
+	// invalid bounds are still reported when the field is set.
+	for _, tc := range []struct{ conf, msg string }{
+		{ "name x;", "min/max: string is not a number" },
+		{ "port 1;", "invalid bound lots" },
+	} {
+		var b BadBound
+		p, _ := NewParserFromString(tc.conf, ParserSemi)
+		if err := p.Parse(&b); err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected %q, got %v", tc.conf, tc.msg, err)
+		}
+	}
+}
+
+type Backend struct {
+	Name_		string
+	Address		string
+	Hostname	string
+}
+
+func (b *Backend) Validate() error {
+	if (b.Address == "") == (b.Hostname == "") {
+		return errors.New("either address or hostname must be set")
+	}
+	return nil
+}
+
+type BackendMain struct {
+	Backend		[]Backend
+	Primary		string
+	pos		Position
+}
+
+func (m *BackendMain) ValidateAt(pos Position) error {
+	m.pos = pos
+	for _, b := range m.Backend {
+		if b.Name_ == m.Primary {
+			return nil
+		}
+	}
+	return fmt.Errorf("primary backend %s not found", m.Primary)
+}
+
+type Part struct {
+	Name_	string
+	Ports	[]int
+	ends	int
+}
+
+func (p *Part) ValidateSection(pos Position) error {
+	p.ends++
+	if len(p.Ports) > 2 {
+		return fmt.Errorf("too many ports at line %d", pos.Line)
+	}
+	return nil
+}
+
+type PartMain struct {
+	Part	[]Part
+}
+
+func TestValidate(t *testing.T) {
+	conf := `
+primary one;
+backend one {
+	address 10.0.0.1;
+}
+backend two {
+	address 10.0.0.2;
+}
+backend two hostname two.example;
+`
+	var m BackendMain
+	p, _ := NewParserFromString(conf, ParserSemi)
+	err := p.Parse(&m)
+	pe, ok := err.(*ParseError)
+	if !ok || len(pe.Diagnostics) != 1 {
+		t.Fatalf("expected one error, got %v", err)
+	}
+	d := pe.Diagnostics[0]
+	if d.Code != CodeValidate || d.Span.Start.Line != 6 ||
+	   d.Message != "section backend: either address or hostname must be set" {
+		t.Errorf("unexpected error %s", d)
+	}
+	if m.pos.Line != 1 {
+		t.Errorf("unexpected position %+v", m.pos)
+	}
+
+	var m2 BackendMain
+	p, _ = NewParserFromString("primary three; backend one address 1.2.3.4;", ParserSemi)
+	err = p.Parse(&m2)
+	if err == nil || err.Error() != "primary backend three not found" ||
+	   err.(*ParseError).Diagnostics[0].Code != CodeValidate {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// ValidateSection is called at the end of every part.
+	for _, parse := range []func(string, *PartMain) error{
+		func(conf string, pm *PartMain) error {
+			p, _ := NewParserFromString(conf, ParserSemi)
+			return p.Parse(pm)
+		},
+		func(conf string, pm *PartMain) error {
+			p, _ := NewParserFromString(conf, ParserSemi)
+			doc, err := p.ParseAST()
+			if err != nil {
+				return err
+			}
+			return Decode(doc, pm)
+		},
+	} {
+		var pm PartMain
+		err = parse("part a { ports 1; }\npart b ports 2;\npart a ports 3, 4;\n", &pm)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Span.Start.Line != 3 ||
+		   !strings.HasSuffix(pe.Diagnostics[0].Message, "too many ports at line 3") {
+			t.Errorf("expected an error at line 3, got %v", err)
+		}
+		if len(pm.Part) != 2 || pm.Part[0].ends != 2 || pm.Part[1].ends != 1 {
+			t.Errorf("unexpected calls: %+v", pm.Part)
+		}
+	}
+}
+
+func TestHolder(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.conf":	"include \"limits.conf\";\n",
+		"limits.conf":	"port 80; peer a;\n",
+	})
+	main := filepath.Join(dir, "main.conf")
+	limits := filepath.Join(dir, "limits.conf")
+
+	h, err := NewHolder[Limits](main, ParserSemi, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Load().Port != 80 {
+		t.Fatalf("unexpected config %+v", h.Load())
+	}
+
+	reloaded := make(chan [2]*Limits, 1)
+	failed := make(chan error, 1)
+	h.Subscribe(func(old, new *Limits) {
+		reloaded <- [2]*Limits{ old, new }
+	})
+	h.OnError(func(err error) {
+		failed <- err
+	})
+	h.Watch(10 * time.Millisecond, syscall.SIGHUP)
+	defer h.Stop()
+
+	// a change in an included file.
+	update := func(data string, age time.Duration) {
+		if err := os.WriteFile(limits, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mt := time.Now().Add(age)
+		os.Chtimes(limits, mt, mt)
+	}
+	update("port 81; peer a;\n", time.Hour)
+	select {
+		case r := <-reloaded:
+			if r[0].Port != 80 || r[1].Port != 81 || h.Load().Port != 81 {
+				t.Errorf("unexpected reload %+v %+v", r[0], r[1])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("file change not noticed")
+	}
+
+	// a bad file keeps the old configuration.
+	update("port 0;\n", 2 * time.Hour)
+	select {
+		case err := <-failed:
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("unexpected error %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("bad file not noticed")
+	}
+	if h.Load().Port != 81 {
+		t.Errorf("old configuration not kept: %+v", h.Load())
+	}
+
+	// SIGHUP forces a reload.
+	update("port 82; peer a;\n", 2 * time.Hour)
+	proc, _ := os.FindProcess(os.Getpid())
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		t.Skip("cannot send SIGHUP:", err)
+	}
+	select {
+		case r := <-reloaded:
+			if r[1].Port != 82 {
+				t.Errorf("unexpected reload %+v", r[1])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("SIGHUP not handled")
+	}
+
+	// a change with the same size and mtime. (The file may also
+	// have been reloaded for SIGHUP and by the ticker.)
+	update("port 83; peer a;\n", 2 * time.Hour)
+	timeout := time.After(5 * time.Second)
+	for h.Load().Port != 83 {
+		select {
+			case <-reloaded:
+			case <-timeout:
+				t.Fatal("change with the same size and mtime not noticed")
+		}
+	}
+
+	// an error in a file that is new after the last good reload,
+	// and fixing it.
+	extra := filepath.Join(dir, "extra.conf")
+	os.WriteFile(extra, []byte("user x1;\n"), 0644)
+	os.WriteFile(main, []byte("include \"limits.conf\";\ninclude \"extra.conf\";\n"), 0644)
+	select {
+		case <-failed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("bad included file not noticed")
+	}
+	os.WriteFile(extra, []byte("user lucy;\n"), 0644)
+	timeout = time.After(5 * time.Second)
+	for h.Load().User != "lucy" {
+		select {
+			case <-reloaded:
+			case <-timeout:
+				t.Fatal("fix in new included file not noticed")
+		}
+	}
+}
+
+func TestReaderFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/main.conf":	{ Data: []byte("include \"conf.d/*.conf\";\nnet 194.109.6.66/32;\n") },
+		"etc/conf.d/a.conf":	{ Data: []byte("file file1 {\n\tinclude \"../dir.inc\";\n}\n") },
+		"etc/conf.d/b.conf":	{ Data: []byte("file file2 dir /tmp;\n") },
+		"etc/dir.inc":		{ Data: []byte("dir /var/tmp;\n") },
+		"loop.conf":		{ Data: []byte("include \"/etc/../loop.conf\";\n") },
+	}
+	var top Main
+	p, err := NewParserFS(fsys, "etc/main.conf", ParserSemi)
+	if err == nil {
+		err = p.Parse(&top)
+	}
+	if err != nil {
+		t.Fatal(err.(*ParseError).LongError())
+	}
+	if len(top.File) != 2 || top.File[0].Dir != "/var/tmp" ||
+	   top.File[1].Dir != "/tmp" || len(top.Net) != 1 {
+		t.Errorf("unexpected result %+v", top)
+	}
+	want := []string{ "etc/main.conf", "etc/conf.d/a.conf", "etc/conf.d/b.conf", "etc/dir.inc" }
+	if !reflect.DeepEqual(p.Files(), want) {
+		t.Errorf("expected files %v, got %v", want, p.Files())
+	}
+
+	p, _ = NewParserFS(fsys, "loop.conf", ParserSemi)
+	err = p.Parse(&top)
+	if err == nil || !strings.Contains(err.Error(), "include loop") {
+		t.Errorf("expected include loop, got %v", err)
+	}
+
+	_, err = NewParserFS(fsys, "nonexistent.conf", ParserSemi)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	var top2 Main
+	r := strings.NewReader("file file1 {\n\tdir /var/tmp\n}\n")
+	p, _ = NewParserFromReader(r, "<stdin>", ParserSemi)
+	err = p.Parse(&top2)
+	if err == nil || !strings.HasPrefix(err.Error(), "<stdin>:3.1:") {
+		t.Errorf("expected error in <stdin>, got %v", err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.conf":	"include \"file.inc\";\nnet 194.109.6.66/32;\n",
+		"file.inc":	"file file1 {\n\tdir /var/tmp;\n}\n",
+	})
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var top TextMain
+			var p *Parser
+			var err error
+			switch i % 3 {
+				case 0:
+					p, err = NewParser(filepath.Join(dir, "main.conf"), ParserSemi)
+				case 1:
+					p, err = NewParserFromString(conf1, ParserSemi)
+				case 2:
+					p, err = NewParserFromString(conf2, ParserDiablo)
+			}
+			if err == nil {
+				err = p.Parse(&top)
+			}
+			if err == nil && (len(top.File) == 0 || top.File[0].Dir != "/var/tmp") {
+				err = fmt.Errorf("parser %d: unexpected result %+v", i, top)
+			}
+			if err == nil {
+				_, err = Marshal(&top, ParserSemi)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// The tokenizer as it was before the hand-written scanners: every
+// regular expression in the token table is tried, and the longest
+// match wins. This is the reference for the scanners.
+var reTokdef = func() (r []*regexp.Regexp) {
+	for _, d := range tokdef.defs {
+		r = append(r, regexp.MustCompile("^" + d.Match))
+	}
+	return
+}()
+
+func rePeek(b []byte) (tok uint64, n int) {
+	tok, n = tokUnknown, -1
+	for i, re := range reTokdef {
+		s := re.Find(b)
+		if s != nil && len(s) >= n {
+			if len(s) == n {
+				tok |= tokdef.defs[i].Token
+			} else {
+				n = len(s)
+				tok = tokdef.defs[i].Token
+			}
+		}
+	}
+	if n < 0 {
+		_, n = utf8.DecodeRune(b)
+	}
+	return
+}
+
+func scanPeek(b []byte) (tok uint64, n int) {
+	l := newtokenizer(b, tokdef)
+	l.SetSpace("")
+	t := l.peek()
+	return t.Token, len(t.Value)
+}
+
+func checkScan(t *testing.T, s string) {
+	b := []byte(s)
+	for i := range b {
+		rt, rn := rePeek(b[i:])
+		st, sn := scanPeek(b[i:])
+		if rt != st || rn != sn {
+			t.Errorf("%q: regexp %#x len %d, scanner %#x len %d",
+				s[i:], rt, rn, st, sn)
+		}
+	}
+}
+
+var scanCorpus = []string{
+	"file1", "end", "endless", "abc-", "a-b-c", "x--y",
+	"10", "10k", "10KB", "1.5", "1.", "1.2.3", "-5", "+5k", "-", "0x1F", "0x",
+	"0x_1f", "0x__1", "0o17", "0o8", "0b101", "0b2", "1_000", "1__0", "1_",
+	"64KiB", "1.5GiB", "512MB", "1EB", "1e5B", "1eb", "1E5", "100B", "10kb",
+	"1_024KiB", "1.5iB", "5Kib", "5Ki", "1e5EB", "7pB", "1.5e-3GB",
+	"1e6", "1E-3", "1e+", "1.5k", "-1.5e3m", "1.e5", "0x1Fk", "1.5.6", "1.2.3.4", "1.2.3.4/24",
+	"1.2.3.4567", "1.2.3.4:80", "1.2.3.4/24:80", "1.2.3.4/:80", "1.2.3.4567:80",
+	"1234.1.1.1", "*", "*:80", "*.*", "@comp.*", "!alt.binaries.*", "@", "a.b.",
+	"www.example.com", "www.example.com:80", "a-.b", "a.-b", "a.b-", "a.b-:80",
+	"K.ſ", "a.KK", "x.é",
+	"::", ":::", "::1", "::1/128", "1::", "1::2", "1:2", "fe80::1:2:3",
+	"1:2:3:4:5:6:7:8", "1:2:3:4:5:6:7:8:9", "1:2:3:4:5:6:7::", "abcde::1",
+	"[::1]:80", "[1:2:3:4:5:6:7:8]:443", "[::1/64]:80", "[fe80::1]", "[::]:1",
+	"[1::2:3]:4", "[1:2::abcd5]:1",
+	`"hello"`, `""`, `"""`, `"`, `""x`, `"a\"b"`, `"a\\"b"`, `"unterminated`, `"a:"`, `"\`,
+	"/etc/passwd", "./x", "../x", ".../x", "/", "//", "//x", "# comment\nx",
+	"// comment", "/x//y", "{}();,=\n",
+	"${a}", "/srv/${app}/log;", "x${a}${b}y z", "${a", "${a\n}", "$x", "a$${b}",
+	"${a}:80", "10.${net}.0.1", "#${a}", "//${a}", "${}", "é${a}", "$$${a}", "a$$b${c}",
+}
+
+func TestScanner(t *testing.T) {
+	for _, s := range scanCorpus {
+		checkScan(t, s)
+	}
+
+	const chars = "0123456789abcdefkmxzKABF.:/-_[]*@!+\"\\# \n{};,=Kſé${}"
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000 && !t.Failed(); i++ {
+		var sb strings.Builder
+		for j := rnd.Intn(24); j >= 0; j-- {
+			c := []rune(chars)
+			sb.WriteRune(c[rnd.Intn(len(c))])
+		}
+		checkScan(t, sb.String())
+	}
+}
+
+func TestScanHexSuffix(t *testing.T) {
+	// a hex number has no k/m/g/t suffix, like a hex size has no unit.
+	for _, tc := range []struct{ s string; n int }{
+		{ "0x1Fk", 0 }, { "-0xfft", 0 }, { "0x1F", 4 }, { "0o17k", 5 },
+		{ "0b1m", 4 }, { "12k", 3 },
+	} {
+		n := scanInt([]byte(tc.s))
+		if tc.n == 0 && n == len(tc.s) || tc.n != 0 && n != tc.n {
+			t.Errorf("%s: scanned %d bytes as a number", tc.s, n)
+		}
+		tok, n := scanPeek([]byte(tc.s))
+		if tc.n == 0 && (tok & tokInt) != 0 && n == len(tc.s) {
+			t.Errorf("%s: read as an integer", tc.s)
+		}
+	}
+}
+
+func FuzzScanner(f *testing.F) {
+	for _, s := range scanCorpus {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		checkScan(t, s)
+	})
+}
+
+//
+//	A Diablo configuration of about 4 MB.
+//
+func benchData() []byte {
+	entry := `# feed %d
+label feed%d
+	hostname news%d.example.com
+	alias 10.1.%d.2/32, [fe80::%x]:119
+	groups @*,!junk,!control.*,alt.binaries.%d.*
+	maxsize 100k
+	delay 1.5
+	spool "/var/spool/news %d"
+end
+`
+	var b bytes.Buffer
+	for i := 0; b.Len() < 4 << 20; i++ {
+		fmt.Fprintf(&b, entry, i, i, i, i % 256, i, i, i)
+	}
+	return b.Bytes()
+}
+
+func BenchmarkTokenizer(b *testing.B) {
+	data := benchData()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := newtokenizer(data, tokdef)
+		for t := l.Next(); t.Token != tokEOF; t = l.Next() {
+			if t.Token == tokUnknown {
+				b.Fatalf("unknown token at %d.%d", t.Pos.Line, t.Pos.Column)
+			}
+		}
+	}
+}
+
+func BenchmarkTokenizerRegexp(b *testing.B) {
+	data := benchData()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for off := 0; off < len(data); {
+			if defaultSpace[data[off]] {
+				off++
+				continue
+			}
+			tok, n := rePeek(data[off:])
+			if tok == tokUnknown {
+				b.Fatalf("unknown token at %d", off)
+			}
+			off += n
+		}
+	}
+}
+
+type Numbers struct {
+	I	int
+	I64	int64
+	U32	uint32
+	U	uint64
+	F	float64
+}
+
+func TestNumbers(t *testing.T) {
+	good := []struct {
+		conf	string
+		want	Numbers
+	}{
+		{ "i -5; u 0x1F; f 1e6;", Numbers{ I: -5, U: 31, F: 1e6 } },
+		{ "i +5k; i64 0o17; u32 0b1010;", Numbers{ I: 5000, I64: 15, U32: 10 } },
+		{ "i 1_000_000; u 0x_ff_ff; f -2.5E-3;", Numbers{ I: 1000000, U: 65535, F: -0.0025 } },
+		{ "u 0x1F; f inf;", Numbers{ U: 31, F: math.Inf(1) } },
+		{ "i 1.5k; i64 -2.25m; u32 4g; f 1.5k;", Numbers{ I: 1500, I64: -2250000, U32: 4000000000, F: 1500 } },
+		{ "u 18446744073709551615; i64 -9223372036854775808;",
+		  Numbers{ U: 18446744073709551615, I64: -9223372036854775808 } },
+	}
+	for _, tc := range good {
+		var n Numbers
+		p, _ := NewParserFromString(tc.conf, ParserSemi)
+		if err := p.Parse(&n); err != nil {
+			t.Errorf("%s: %s", tc.conf, err)
+		} else if n != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.conf, n, tc.want)
+		}
+	}
+
+	bad := []struct {
+		conf	string
+		msg	string
+	}{
+		{ "u32 5g;", "value out of range" },
+		{ "i64 10000000t;", "value out of range" },
+		{ "u -1;", "value out of range" },
+		{ "i 1.5;", "1.5 is not an integer" },
+		{ "f 1e400;", "value out of range" },
+		{ "u 0x1Fk;", "expected ';'" },
+		{ `u "0x1Fk";`, "invalid syntax" },
+	}
+	for _, tc := range bad {
+		var n Numbers
+		p, _ := NewParserFromString(tc.conf, ParserSemi)
+		err := p.Parse(&n)
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected %q, got %v", tc.conf, tc.msg, err)
+		}
+	}
+}
+
+type Port uint16
+
+type Widths struct {
+	I8	int8
+	I16	int16
+	I32	int32
+	U8	uint8
+	U16	uint16
+	Port	Port
+	F32	float32
+	C	complex128
+	Key	[]byte
+	Keys	[][]byte
+}
+
+func TestWidths(t *testing.T) {
+	conf := `
+i8 -128; i16 32767; i32 -2g; u8 255; u16 0xffff; port 8080;
+f32 1.5; c "-1-2i"; key "hex:00ff10"; keys "aGVsbG8=", "base64:d29ybGQ";
+`
+	var w Widths
+	p, _ := NewParserFromString(conf, ParserSemi)
+	if err := p.Parse(&w); err != nil {
+		t.Fatal(err)
+	}
+	want := Widths{ I8: -128, I16: 32767, I32: -2000000000, U8: 255, U16: 65535,
+		Port: 8080, F32: 1.5, C: complex(-1, -2), Key: []byte{ 0, 255, 16 },
+		Keys: [][]byte{ []byte("hello"), []byte("world") } }
+	if !reflect.DeepEqual(w, want) {
+		t.Errorf("got %+v, want %+v", w, want)
+	}
+
+	out, err := Marshal(&w, ParserSemi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w2 Widths
+	p, _ = NewParserFromString(string(out), ParserSemi)
+	if err := p.Parse(&w2); err != nil || !reflect.DeepEqual(w, w2) {
+		t.Errorf("round trip failed: %v\n%s", err, out)
+	}
+
+	// base64 that looks like a hex number ("0xAA") is still base64.
+	for _, key := range [][]byte{ { 0xD3, 0x10, 0x00 }, { 0xD3, 0x1F, 0xFF }, { 0xfb, 0xff } } {
+		w := Widths{ Key: key }
+		out, err := Marshal(&w, ParserSemi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w2 Widths
+		p, _ = NewParserFromString(string(out), ParserSemi)
+		if err := p.Parse(&w2); err != nil || !bytes.Equal(w2.Key, key) {
+			t.Errorf("%x: round trip failed: %v, got %x\n%s", key, err, w2.Key, out)
+		}
+	}
+	if err := setValue(reflect.ValueOf(&w2.Key).Elem(), "hex:0g", nil, nil); err == nil {
+		t.Errorf("hex:0g: expected an error")
+	}
+
+	for _, conf := range []string{ "i8 128;", "i16 -40k;", "u8 256;", "u16 -1;",
+	    "port 65536;", "i32 3g;", "f32 1e39;" } {
+		var w Widths
+		p, _ := NewParserFromString(conf, ParserSemi)
+		err := p.Parse(&w)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || !errors.Is(err, strconv.ErrRange) ||
+		   pe.Diagnostics[0].Span.Start.Column != strings.Index(conf, " ") + 2 {
+			t.Errorf("%s: expected range error at the value, got %v", conf, err)
+		}
+	}
+}
+
+type Sizes struct {
+	Cache	ByteSize
+	Buffer	int		`cc:"buffer,bytesize,default=64KiB"`
+	Small	uint16		`cc:"small,bytesize"`
+	Limits	[]ByteSize
+	Quota	int64		`cc:"quota,bytesize,min=1KiB,max=1GiB"`
+}
+
+func TestByteSize(t *testing.T) {
+	conf := `
+cache 1.5GiB;
+small 60kB;
+limits 512MB, 64KiB, 100, 1e3B, 2EiB, "4 TB";
+`
+	var s Sizes
+	p, _ := NewParserFromString(conf, ParserSemi)
+	if err := p.Parse(&s); err != nil {
+		t.Fatal(err)
+	}
+	want := Sizes{ Cache: 3 << 29, Buffer: 65536, Small: 60000,
+		Limits: []ByteSize{ 512000000, 65536, 100, 1000, 2 << 60, 4e12 } }
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+
+	for in, out := range map[ByteSize]string{ 0: "0B", 1536: "1536B",
+	    3 << 29: "1536MiB", 512000000: "512MB", 4e12: "4TB", 1 << 20: "1MiB" } {
+		if in.String() != out {
+			t.Errorf("%d: got %s, want %s", in, in.String(), out)
+		}
+	}
+
+	for _, conf := range []string{ "cache 64k;", "cache 64KB;", "cache 1Mb;",
+	    "cache 0.3KiB;", "cache 20EiB;", "small 64KiB;", "cache 1.5iB;",
+	    `cache "0x10KiB";`, "cache 0x1k;" } {
+		var s Sizes
+		p, _ := NewParserFromString(conf, ParserSemi)
+		err := p.Parse(&s)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeValue {
+			t.Errorf("%s: expected an error, got %v", conf, err)
+		}
+	}
+
+	// a hex number has no unit.
+	if b, err := ParseByteSize("0x1B"); err != nil || b != 27 {
+		t.Errorf("0x1B: got %d, %v", b, err)
+	}
+
+	// min and max are sizes too.
+	p, _ = NewParserFromString("quota 512MiB;", ParserSemi)
+	if err := p.Parse(&s); err != nil || s.Quota != 512 << 20 {
+		t.Errorf("quota 512MiB: got %d, %v", s.Quota, err)
+	}
+	for _, conf := range []string{ "quota 2GiB;", "quota 512B;" } {
+		var s Sizes
+		p, _ := NewParserFromString(conf, ParserSemi)
+		err := p.Parse(&s)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeConstraint {
+			t.Errorf("%s: expected a constraint error, got %v", conf, err)
+		}
+	}
+}
+
+// A resolver that only knows a few names.
+type fakeResolver map[string]string
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	a, ok := r[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, s := range strings.Fields(a) {
+		addrs = append(addrs, net.IPAddr{ IP: net.ParseIP(s) })
+	}
+	return addrs, nil
+}
+
+func (r fakeResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	if service == "http" {
+		return 80, nil
+	}
+	return 0, fmt.Errorf("unknown service")
+}
+
+type Addrs struct {
+	Listen	net.TCPAddr
+	Peer	net.IPAddr
+	Any	net.TCPAddr
+}
+
+func TestResolver(t *testing.T) {
+	res := fakeResolver{
+		"www.example.com": "2001:db8::1 192.0.2.1",
+		"db.example.com": "2001:db8::2",
+	}
+	conf := `listen "www.example.com:http"; peer db.example.com; any ":25";`
+	var a Addrs
+	p, _ := NewParserFromString(conf, ParserSemi)
+	p.SetResolver(res)
+	if err := p.Parse(&a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Listen.String() != "192.0.2.1:80" || a.Peer.String() != "2001:db8::2" ||
+	   a.Any.IP != nil || a.Any.Port != 25 {
+		t.Errorf("got %v %v %v", &a.Listen, &a.Peer, &a.Any)
+	}
+
+	for _, tc := range []struct{ conf, host string; noResolve bool }{
+		{ "peer nowhere.example.com;", "nowhere.example.com", false },
+		{ `listen "db.example.com:80";`, "", false },
+		{ "peer db.example.com;", "db.example.com", true },
+		{ `listen "192.0.2.1:http";`, "http", true },
+	} {
+		var a Addrs
+		p, _ := NewParserFromString(tc.conf, ParserSemi)
+		p.SetResolver(res)
+		p.SetNoResolve(tc.noResolve)
+		err := p.Parse(&a)
+		if tc.host == "" {
+			if err != nil || a.Listen.String() != "[2001:db8::2]:80" {
+				t.Errorf("%s: got %v, %v", tc.conf, &a.Listen, err)
+			}
+			continue
+		}
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeValue ||
+		   pe.Diagnostics[0].Span.Start.Column != strings.Index(tc.conf, " ") + 2 ||
+		   !strings.Contains(err.Error(), tc.host) {
+			t.Errorf("%s: expected an error naming %s, got %v", tc.conf, tc.host, err)
+		}
+	}
+
+	// so does Decode.
+	p, _ = NewParserFromString(conf, ParserSemi)
+	p.SetResolver(res)
+	doc, err := p.ParseAST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = Addrs{}
+	if err := p.Decode(doc, &a); err != nil || a.Listen.String() != "192.0.2.1:80" {
+		t.Errorf("Decode: got %v, %v", &a.Listen, err)
+	}
+	p, _ = NewParserFromString("peer db.example.com;", ParserSemi)
+	p.SetNoResolve(true)
+	doc, _ = p.ParseAST()
+	if err := p.Decode(doc, &a); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("Decode: expected an error, got %v", err)
+	}
+
+	// literal addresses work without a resolver.
+	p, _ = NewParserFromString(`listen "[fe80::1%eth0]:53"; peer 10.1.2.3;`, ParserSemi)
+	p.SetNoResolve(true)
+	a = Addrs{}
+	if err := p.Parse(&a); err != nil || a.Listen.Zone != "eth0" ||
+	   a.Peer.String() != "10.1.2.3" {
+		t.Errorf("got %v %v, %v", &a.Listen, &a.Peer, err)
+	}
+}
+
+type ValueTypes struct {
+	IP	net.IP
+	MAC	net.HardwareAddr
+	UDP	net.UDPAddr
+	Sock	net.UnixAddr
+	Addr	netip.Addr
+	Prefix	netip.Prefix
+	AddrPort netip.AddrPort
+	URL	url.URL
+	Re	*regexp.Regexp
+	Mode	os.FileMode
+	Dir	fs.FileMode
+	Mail	mail.Address
+}
+
+func TestValueTypes(t *testing.T) {
+	conf := `
+ip 10.1.2.3; mac "00:1a:2b:3c:4d:5e"; udp 192.0.2.1:53; sock /run/app.sock;
+addr "fe80::1"; prefix "10.0.0.0/8"; addrport "[::1]:8080";
+url "https://example.com/a?b=c"; re "^[a-z]+\\.conf$"; mode 0640; dir 1777;
+mail "Snoopy <snoopy@example.com>";
+`
+	var v ValueTypes
+	p, _ := NewParserFromString(conf, ParserSemi)
+	p.SetNoResolve(true)
+	if err := p.Parse(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.IP.String() != "10.1.2.3" || v.MAC.String() != "00:1a:2b:3c:4d:5e" ||
+	   v.UDP.String() != "192.0.2.1:53" || v.Sock.Name != "/run/app.sock" ||
+	   v.Addr.String() != "fe80::1" || v.Prefix.Bits() != 8 ||
+	   v.AddrPort.Port() != 8080 || v.URL.Host != "example.com" ||
+	   !v.Re.MatchString("app.conf") || v.Re.MatchString("app-conf") ||
+	   v.Mode != 0640 || v.Dir != fs.ModeSticky | 0777 ||
+	   v.Mail.Name != "Snoopy" || v.Mail.Address != "snoopy@example.com" {
+		t.Errorf("got %+v", v)
+	}
+
+	out, err := Marshal(&v, ParserSemi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v2 ValueTypes
+	p, _ = NewParserFromString(string(out), ParserSemi)
+	if err := p.Parse(&v2); err != nil || !reflect.DeepEqual(v, v2) {
+		t.Errorf("round trip failed: %v\n%s", err, out)
+	}
+
+	for _, conf := range []string{ "ip 10.1.2.300;", `mac "00:1a";`,
+	    "mode 0800;", "mode 10000;", `re "a(";`, `mail "nobody";`,
+	    `prefix "10.0.0.0/33";`, `url "http://[::1";` } {
+		var v ValueTypes
+		p, _ := NewParserFromString(conf, ParserSemi)
+		err := p.Parse(&v)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeValue {
+			t.Errorf("%s: expected an error, got %v", conf, err)
+		}
+	}
+}
+
+// A type from "another package", without UnmarshalText.
+type RateLimit struct {
+	N	int
+	Per	time.Duration
+}
+
+type Celsius float64
+
+type Limited struct {
+	Limit	RateLimit
+	Limits	[]RateLimit
+	Burst	*RateLimit
+	Temp	Celsius
+}
+
+func parseRateLimit(s string) (interface{}, error) {
+	var r RateLimit
+	var per string
+	if _, err := fmt.Sscanf(s, "%d/%s", &r.N, &per); err != nil {
+		return nil, fmt.Errorf("invalid rate %s", s)
+	}
+	d, err := time.ParseDuration("1" + per)
+	r.Per = d
+	return r, err
+}
+
+func TestConverter(t *testing.T) {
+	tp := reflect.TypeOf(RateLimit{})
+	RegisterConverter(tp, parseRateLimit)
+	defer RegisterConverter(tp, nil)
+
+	conf := `limit "100/s"; limits "5/m", "1/h"; burst "10/ms"; temp "21.5C";`
+	var l Limited
+	p, _ := NewParserFromString(conf, ParserSemi)
+	p.RegisterConverter(reflect.TypeOf(Celsius(0)), func(s string) (interface{}, error) {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(s, "C"), 64)
+		return Celsius(f), err
+	})
+	if err := p.Parse(&l); err != nil {
+		t.Fatal(err)
+	}
+	want := Limited{
+		Limit: RateLimit{ 100, time.Second },
+		Limits: []RateLimit{ { 5, time.Minute }, { 1, time.Hour } },
+		Burst: &RateLimit{ 10, time.Millisecond },
+		Temp: 21.5,
+	}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("got %+v, want %+v", l, want)
+	}
+
+	// the Celsius converter is only for that parser, and
+	// a converter must return the right type.
+	p, _ = NewParserFromString(`temp "21.5C";`, ParserSemi)
+	if err := p.Parse(&l); err == nil {
+		t.Errorf("expected an error without the Celsius converter")
+	}
+	p, _ = NewParserFromString(`limit "1/s";`, ParserSemi)
+	p.RegisterConverter(tp, func(s string) (interface{}, error) { return 1, nil })
+	err := p.Parse(&l)
+	if err == nil || !strings.Contains(err.Error(), "returned a int") {
+		t.Errorf("expected a type error, got %v", err)
+	}
+	p, _ = NewParserFromString(`limit "fast";`, ParserSemi)
+	err = p.Parse(&l)
+	pe, ok := err.(*ParseError)
+	if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeValue ||
+	   pe.Diagnostics[0].Span.Start.Column != 7 {
+		t.Errorf("expected an error at the value, got %v", err)
+	}
+}
+
+// A path that is relative to the file it is in.
+type ConfPath struct {
+	Path	string
+	Line	int
+}
+
+func (c *ConfPath) UnmarshalCurly(v Value) error {
+	if !v.Class.Has(ClassFilename | ClassString) {
+		return fmt.Errorf("%s is not a path", v.Raw)
+	}
+	c.Path, c.Line = v.Text, v.Start.Line
+	if v.Dir != "" && !filepath.IsAbs(c.Path) {
+		c.Path = filepath.Join(v.Dir, c.Path)
+	}
+	return nil
+}
+
+type TLSConf struct {
+	Cert	ConfPath
+	Key	ConfPath
+	CA	ConfPath	`cc:"ca,default=./ca.pem"`
+	Extra	[]ConfPath
+}
+
+func TestUnmarshalCurly(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.conf": "include ./sub/tls.conf;\n",
+		"sub/tls.conf": "cert ./cert.pem;\nkey \"/etc/key file.pem\";\n" +
+			"extra ../a.pem, ./b.pem;\n",
+	})
+	var c TLSConf
+	p, _ := NewParser(filepath.Join(dir, "main.conf"), ParserSemi)
+	if err := p.Parse(&c); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "sub")
+	want := TLSConf{
+		Cert: ConfPath{ filepath.Join(sub, "cert.pem"), 1 },
+		Key: ConfPath{ "/etc/key file.pem", 2 },
+		CA: ConfPath{ "./ca.pem", 0 },
+		Extra: []ConfPath{ { filepath.Join(dir, "a.pem"), 3 },
+			{ filepath.Join(sub, "b.pem"), 3 } },
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+
+	p, _ = NewParserFromString("cert 10.1.2.3;", ParserSemi)
+	err := p.Parse(&c)
+	pe, ok := err.(*ParseError)
+	if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Span.Start.Column != 6 ||
+	   !strings.Contains(err.Error(), "10.1.2.3 is not a path") {
+		t.Errorf("expected an error at the value, got %v", err)
+	}
+}
+
+type VarServer struct {
+	Name_	string
+	Root	string
+	Listen	net.TCPAddr
+}
+
+type VarConf struct {
+	Logdir	string
+	Motd	string
+	Server	[]VarServer
+}
+
+func TestVariables(t *testing.T) {
+	conf := `
+set base /srv/app;
+set net "10.1";
+logdir ${base}/log;
+motd "Welcome to ${name}, $${literal}";
+server web {
+	set base /srv/web;
+	root ${base}/htdocs;
+	listen ${net}.0.1:80;
+}
+server db {
+	root ${base}/data;
+}
+`
+	want := VarConf{
+		Logdir: "/srv/app/log",
+		Motd: "Welcome to snoopy, ${literal}",
+		Server: []VarServer{
+			{ Name_: "web", Root: "/srv/web/htdocs",
+			  Listen: net.TCPAddr{ IP: net.ParseIP("10.1.0.1"), Port: 80 } },
+			{ Name_: "db", Root: "/srv/app/data" },
+		},
+	}
+	var c VarConf
+	p, _ := NewParserFromString(conf, ParserSemi)
+	p.SetVar("name", "snoopy")
+	if err := p.Parse(&c); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+
+	// the same through the syntax tree.
+	p, _ = NewParserFromString(conf, ParserSemi)
+	p.SetVar("name", "snoopy")
+	doc, err := p.ParseAST()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = VarConf{}
+	if err := p.Decode(doc, &c); err != nil || !reflect.DeepEqual(c, want) {
+		t.Errorf("Decode: got %+v, %v", c, err)
+	}
+
+	for _, tc := range []struct{ conf string; code string; col int }{
+		{ "logdir ${nope}/log;", CodeVariable, 8 },
+		{ "server a { set x 1; } server b { root ${x}; }", CodeVariable, 39 },
+		{ `motd "${unterminated";`, CodeVariable, 6 },
+		{ "logdir $base;", CodeSyntax, 8 },
+	} {
+		var c VarConf
+		p, _ := NewParserFromString(tc.conf, ParserSemi)
+		p.SetExpandVars(true)
+		err := p.Parse(&c)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) == 0 || pe.Diagnostics[0].Code != tc.code ||
+		   pe.Diagnostics[0].Span.Start.Column != tc.col {
+			t.Errorf("%s: expected a %s error at column %d, got %v",
+				tc.conf, tc.code, tc.col, err)
+		}
+	}
+
+	// With variables on, set is a keyword, also in a map section.
+	var ic IncludeConf
+	p, _ = NewParserFromString("headers { set x 1; x-a ${x}; }", ParserSemi)
+	p.SetExpandVars(true)
+	if err := p.Parse(&ic); err != nil || len(ic.Headers) != 1 ||
+	   ic.Headers["x-a"] != "1" {
+		t.Errorf("set in map: got %+v, %v", ic, err)
+	}
+
+	// $${ is a literal ${, also in a value that is not quoted.
+	c = VarConf{}
+	p, _ = NewParserFromString("logdir /srv/$${x}/${y};", ParserSemi)
+	p.SetVar("y", "log")
+	if err := p.Parse(&c); err != nil || c.Logdir != "/srv/${x}/log" {
+		t.Errorf("$${: got %q, %v", c.Logdir, err)
+	}
+
+	// Marshal and the Editor write ${ as $${ if the parser expands
+	// variables, so it reads back either way.
+	lit := VarConf{ Logdir: "/srv/${base}", Motd: "cost ${price}, $${x}",
+		Server: []VarServer{ { Name_: "a${b}", Root: "${c}" } } }
+	for _, expand := range []bool{ false, true } {
+		for _, how := range []int{ ParserSemi, ParserNL, ParserDiablo } {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf, how)
+			enc.SetExpandVars(expand)
+			if err := enc.Encode(&lit); err != nil {
+				t.Fatal(err)
+			}
+			var c VarConf
+			p, _ := NewParserFromString(buf.String(), how)
+			p.SetExpandVars(expand)
+			if err := p.Parse(&c); err != nil || !reflect.DeepEqual(c, lit) {
+				t.Errorf("%d/%v: round trip failed: %v, %+v\n%s",
+					how, expand, err, c, buf.String())
+			}
+		}
+		e, _ := NewEditorFromString("motd x;\n", ParserSemi)
+		e.SetExpandVars(expand)
+		if err := e.Set("motd", "cost ${price}"); err != nil {
+			t.Fatal(err)
+		}
+		c = VarConf{}
+		p, _ = NewParserFromString(string(e.Bytes()), ParserSemi)
+		p.SetExpandVars(expand)
+		if err := p.Parse(&c); err != nil || c.Motd != "cost ${price}" {
+			t.Errorf("Editor %v: got %q, %v\n%s", expand, c.Motd, err, e.Bytes())
+		}
+	}
+}
+
+func TestVariablesOff(t *testing.T) {
+	// A file from before variables existed reads the same: without
+	// SetExpandVars a ${ is text, and set is not a keyword.
+	conf := `
+logdir "/srv/${base}/log";
+motd "cost $${price}";
+server "${name}" {
+	root "${root}";
+}
+`
+	want := VarConf{
+		Logdir: "/srv/${base}/log",
+		Motd: "cost $${price}",
+		Server: []VarServer{ { Name_: "${name}", Root: "${root}" } },
+	}
+	var c VarConf
+	p, _ := NewParserFromString(conf, ParserSemi)
+	if err := p.Parse(&c); err != nil || !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, %v", c, err)
+	}
+
+	p, _ = NewParserFromString("set base /srv;", ParserSemi)
+	err := p.Parse(&c)
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Diagnostics[0].Code != CodeUnknownField {
+		t.Errorf("set: expected unknown field, got %v", err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("APP_PORT", "8080")
+	t.Setenv("APP_EMPTY", "")
+	t.Setenv("HOME", "/home/snoopy")
+	conf := `
+logdir ${env:APP_LOGDIR:-/var/log}/app;
+motd "port ${env:APP_PORT}${env:APP_EMPTY:-}";
+server web {
+	listen ${env:APP_HOST:-127.0.0.1}:${env:APP_PORT};
+}
+`
+	var c VarConf
+	p, _ := NewParserFromString(conf, ParserSemi)
+	p.AllowEnv("APP_*")
+	if err := p.Parse(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Logdir != "/var/log/app" || c.Motd != "port 8080" ||
+	   c.Server[0].Listen.String() != "127.0.0.1:8080" {
+		t.Errorf("got %+v", c)
+	}
+
+	for _, tc := range []struct{ conf, msg string; allow bool }{
+		{ "logdir ${env:APP_PORT};", "not enabled", false },
+		{ "logdir ${env:HOME};", "HOME is not allowed", true },
+		{ "logdir ${env:APP_LOGDIR};", "APP_LOGDIR is not set", true },
+		{ `motd "${env:APP_EMPTY:?must be set}";`, "APP_EMPTY: must be set", true },
+		{ "logdir ${env:APP_PORT:+x};", "expected :- or :?", true },
+	} {
+		var c VarConf
+		p, _ := NewParserFromString(tc.conf, ParserSemi)
+		p.SetExpandVars(true)
+		if tc.allow {
+			p.AllowEnv("APP_*")
+		}
+		err := p.Parse(&c)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeVariable ||
+		   pe.Diagnostics[0].Span.Start.Column != strings.Index(tc.conf, " ") + 2 ||
+		   !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected an error with %q, got %v", tc.conf, tc.msg, err)
+		}
+	}
+}
+
+type Person struct {
+	Name_	string
+	Address	string
+	Alias	[]string
+}
+
+type OverrideMain struct {
+	Person	[]Person
+	MaxConn	int		`cc:"max-conn,required,min=1"`
+	Headers	map[string]string
+	Debug	bool
+}
+
+func TestOverride(t *testing.T) {
+	conf := `
+person charlie { address 10.0.0.5; alias chuck; }
+person snoopy { address 10.0.0.6; }
+headers { x-old yes; }
+`
+	var m OverrideMain
+	p, _ := NewParserFromString(conf, ParserSemi)
+	p.Override("person.charlie.address", "10.0.0.1")
+	p.Override("person[lucy].alias", "a, b")
+	p.Override("max-conn", "10")
+	p.Override("headers.x-new", "bar")
+	p.Override("debug", "")
+	if err := p.Parse(&m); err != nil {
+		t.Fatal(err)
+	}
+	want := OverrideMain{
+		Person: []Person{
+			{ Name_: "charlie", Address: "10.0.0.1", Alias: []string{ "chuck" } },
+			{ Name_: "snoopy", Address: "10.0.0.6" },
+			{ Name_: "lucy", Alias: []string{ "a", "b" } },
+		},
+		MaxConn: 10,
+		Headers: map[string]string{ "x-old": "yes", "x-new": "bar" },
+		Debug: true,
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+
+	t.Setenv("APP_PERSON_SNOOPY_ALIAS", "joe,cool")
+	t.Setenv("APP_MAX_CONN", "20")
+	m = OverrideMain{}
+	p, _ = NewParserFromString(conf, ParserSemi)
+	p.OverrideEnv("APP_")
+	if err := p.Parse(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.MaxConn != 20 || !reflect.DeepEqual(m.Person[1].Alias, []string{ "joe", "cool" }) {
+		t.Errorf("got %+v", m)
+	}
+
+	// section names from the environment ignore case.
+	t.Setenv("APPX_PERSON_CHARLIE_ADDRESS", "10.0.0.1")
+	t.Setenv("APPX_PERSON_WEB_1_ADDRESS", "10.0.0.2")
+	t.Setenv("APPX_PERSON_LINUS_ADDRESS", "10.0.0.3")
+	m = OverrideMain{}
+	p, _ = NewParserFromString("person Charlie { address 1; } person Web-1 { address 2; }", ParserSemi)
+	p.OverrideEnv("APPX_")
+	p.Override("max-conn", "1")
+	if err := p.Parse(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Person) != 3 || m.Person[0].Address != "10.0.0.1" ||
+	   m.Person[1].Address != "10.0.0.2" || m.Person[2].Name_ != "linus" {
+		t.Errorf("got %+v", m.Person)
+	}
+	p, _ = NewParserFromString("person Charlie { address 1; } person charlie { address 2; }", ParserSemi)
+	p.OverrideEnv("APPX_")
+	p.Override("max-conn", "1")
+	err := p.Parse(&OverrideMain{})
+	if err == nil || !strings.Contains(err.Error(), "ambiguous: Charlie, charlie") {
+		t.Errorf("expected an ambiguous name, got %v", err)
+	}
+
+	for _, tc := range []struct{ path, value, msg string }{
+		{ "person.charlie.adress", "x", "unknown field adress (did you mean address?)" },
+		{ "persn.charlie.address", "x", "(did you mean person?)" },
+		{ "max-con", "1", "(did you mean max" },
+		{ "person.charlie", "x", "person[charlie] is a section" },
+		{ "person", "x", "person: section name expected" },
+		{ "max-conn.x", "1", "maxconn is not a section" },
+		{ "max-conn", "0", "less than the minimum" },
+		{ "max-conn", "many", "invalid syntax" },
+	} {
+		var m OverrideMain
+		p, _ := NewParserFromString(conf + "max-conn 5;", ParserSemi)
+		p.Override(tc.path, tc.value)
+		err := p.Parse(&m)
+		pe, ok := err.(*ParseError)
+		if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeOverride ||
+		   !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s=%s: expected an error with %q, got %v",
+				tc.path, tc.value, tc.msg, err)
+		}
+	}
+}
+
+type LayerServer struct {
+	Name_	string
+	Address	string
+	Alias	[]string	`cc:"alias,merge=append"`
+}
+
+type LayerConf struct {
+	Listen	[]string
+	Modules	[]string	`cc:"modules,merge=append"`
+	Server	[]LayerServer
+	Backend	[]LayerServer	`cc:"backend,merge=replace"`
+	Headers	map[string]string
+	Port	int		`cc:"port,default=80"`
+	Admin	string		`cc:"admin,required"`
+}
+
+type LP struct {
+	Name_	string
+	Port	int
+	Host	string
+}
+
+type LPConf struct {
+	Person	[]LP	`cc:"person,merge=append"`
+}
+
+type RP struct {
+	Name_	string
+	Address	string	`cc:"address,required"`
+}
+
+type RPConf struct {
+	Backend	[]RP	`cc:"backend,merge=replace"`
+}
+
+func TestLoader(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"defaults.conf": `
+listen a, b;
+modules m1;
+server web { address 1; alias w1; }
+server db { address 2; }
+backend x { address 9; }
+headers { a 1; }
+admin root;
+`,
+		"site.conf": `
+listen c;
+modules m2;
+server web { alias w2; }
+backend y { address 8; }
+headers { b 2; }
+`,
+		"host.conf": "server web { address 3; }\nport 8080;\n",
+	})
+	l := NewLoader(ParserSemi)
+	l.Add(filepath.Join(dir, "defaults.conf"))
+	l.AddOptional(filepath.Join(dir, "missing.conf"))
+	l.Add(filepath.Join(dir, "site.conf"))
+	l.AddOptional(filepath.Join(dir, "host.conf"))
+	l.Setup(func(p *Parser) { p.SetRecordSources(true) })
+	var c LayerConf
+	if err := l.Load(&c); err != nil {
+		t.Fatal(err)
+	}
+	want := LayerConf{
+		Listen: []string{ "c" },
+		Modules: []string{ "m1", "m2" },
+		Server: []LayerServer{
+			{ Name_: "web", Address: "3", Alias: []string{ "w1", "w2" } },
+			{ Name_: "db", Address: "2" },
+		},
+		Backend: []LayerServer{ { Name_: "y", Address: "8" } },
+		Headers: map[string]string{ "a": "1", "b": "2" },
+		Port: 8080,
+		Admin: "root",
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+	if len(l.Files()) != 3 {
+		t.Errorf("files: %v", l.Files())
+	}
+	for path, file := range map[string]string{
+		"listen": "site.conf", "modules": "site.conf", "server[web].address": "host.conf",
+		"server[web].alias": "site.conf", "server[db].address": "defaults.conf",
+		"backend[y].address": "site.conf", "headers[a]": "defaults.conf",
+		"port": "host.conf", "backend[x].address": "",
+	} {
+		f, ok := l.Origin(path)
+		if filepath.Base(f) != file && !(file == "" && !ok) {
+			t.Errorf("%s: origin %q, want %s", path, f, file)
+		}
+		s, ok := l.Sources()[path]
+		if filepath.Base(s.Pos.File) != file && !(file == "" && !ok) {
+			t.Errorf("%s: source %s, want %s", path, s, file)
+		}
+	}
+
+	// errors are reported for the file they are in.
+	l = NewLoader(ParserSemi)
+	l.Add(filepath.Join(dir, "defaults.conf"))
+	l.Add(filepath.Join(dir, "host.conf"))
+	l.Setup(func(p *Parser) { p.Override("port", "http") })
+	err := l.Load(&c)
+	if err == nil || !strings.Contains(err.Error(), "override port=http") {
+		t.Errorf("expected an override error, got %v", err)
+	}
+	l = NewLoader(ParserSemi)
+	l.Add(filepath.Join(dir, "host.conf"))
+	l.Add(filepath.Join(dir, "missing.conf"))
+	if err := l.Load(&c); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	l = NewLoader(ParserSemi)
+	l.Add(filepath.Join(dir, "host.conf"))
+	c = LayerConf{}
+	err = l.Load(&c)
+	pe, ok := err.(*ParseError)
+	if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeRequired {
+		t.Errorf("expected a missing admin, got %v", err)
+	}
+
+	// append adds sections with the same name; within a layer
+	// they are merged.
+	dir = writeFiles(t, map[string]string{
+		"a.conf": "person snoopy port 1;\n",
+		"b.conf": "person snoopy { port 2; }\nperson snoopy host b;\n",
+	})
+	l = NewLoader(ParserSemi)
+	l.Add(filepath.Join(dir, "a.conf"))
+	l.Add(filepath.Join(dir, "b.conf"))
+	var lp LPConf
+	if err := l.Load(&lp); err != nil {
+		t.Fatal(err)
+	}
+	wantLP := []LP{ { Name_: "snoopy", Port: 1 }, { Name_: "snoopy", Port: 2, Host: "b" } }
+	if !reflect.DeepEqual(lp.Person, wantLP) {
+		t.Errorf("append: got %+v, want %+v", lp.Person, wantLP)
+	}
+	// the second one has its own path, by index.
+	for path, file := range map[string]string{
+		"person[snoopy].port": "a.conf", "person[1].port": "b.conf",
+		"person[1].host": "b.conf",
+	} {
+		if f, _ := l.Origin(path); filepath.Base(f) != file {
+			t.Errorf("append: %s: origin %q, want %s", path, f, file)
+		}
+	}
+
+	// with replace, fields that the dropped layer set are not
+	// seen anymore.
+	dir = writeFiles(t, map[string]string{
+		"a.conf": "backend x { address 1; }\n",
+		"b.conf": "backend x { }\n",
+	})
+	l = NewLoader(ParserSemi)
+	l.Add(filepath.Join(dir, "a.conf"))
+	l.Add(filepath.Join(dir, "b.conf"))
+	var rp RPConf
+	err = l.Load(&rp)
+	pe, ok = err.(*ParseError)
+	if !ok || len(pe.Diagnostics) != 1 || pe.Diagnostics[0].Code != CodeRequired {
+		t.Errorf("replace: expected a missing address, got %v", err)
+	}
+}
+
+func TestSources(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.conf": "admin root;\ninclude \"sub.conf\";\nserver web {\n\taddress 1;\n}\n",
+		"sub.conf": "listen a, b;\nheaders { a 1; }\n",
+	})
+	p, err := NewParser(filepath.Join(dir, "main.conf"), ParserSemi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetRecordSources(true)
+	p.Override("server.web.alias", "w1, w2")
+	var c LayerConf
+	if err := p.Parse(&c); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.conf")
+	sub := filepath.Join(dir, "sub.conf")
+	for path, want := range map[string]string{
+		"admin": main + ":1.1",
+		"listen": sub + ":1.1 (included from " + main + ":2)",
+		"headers[a]": sub + ":2.11 (included from " + main + ":2)",
+		"server[web]": main + ":3.1",
+		"server[web].address": main + ":4.2",
+		"server[web].alias": "override server.web.alias=w1, w2",
+		"port": "default",
+	} {
+		s, ok := p.Source(path)
+		if !ok || s.String() != want {
+			t.Errorf("%s: got %q, want %q", path, s, want)
+		}
+	}
+	if s, _ := p.Source("listen"); len(s.Included) != 1 || s.Origin != OriginFile {
+		t.Errorf("listen: got %+v", s)
+	}
+	if _, ok := p.Source("backend"); ok {
+		t.Errorf("backend: not set, but has a source")
+	}
+
+	// the annotated dump reads back the same.
+	for _, how := range []int{ ParserSemi, ParserNL, ParserDiablo } {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf, how)
+		e.SetSources(p.Sources())
+		if err := e.Encode(&c); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		for _, want := range []string{
+			"\taddress \"1\"",
+			"# " + main + ":4.2\n",
+			"port 80",
+			"# default\n",
+			"# override server.web.alias=w1, w2\n",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%d: %q not in\n%s", how, want, out)
+			}
+		}
+		p2, _ := NewParserFromString(out, how)
+		var c2 LayerConf
+		if err := p2.Parse(&c2); err != nil {
+			t.Errorf("%d: %s\n%s", how, err, out)
+		} else if !reflect.DeepEqual(c, c2) {
+			t.Errorf("%d: got %+v, want %+v", how, c2, c)
+		}
+	}
+}
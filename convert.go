@@ -0,0 +1,153 @@
+//
+//	Converters for types that curlyconf does not know about,
+//	and that cannot implement encoding.TextUnmarshaler, and the
+//	Unmarshaler interface for types that want to know more about
+//	the value than its text.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Unmarshaler is implemented by types that read their value from a
+// configuration file, like encoding.TextUnmarshaler, but want more
+// than the raw text: v has the unquoted text, the token classes
+// (v.Class.Has(ClassIPv4), ClassFilename, ...), the position, and
+// the directory of the file so that relative paths can be resolved.
+//
+// For a default value from a struct tag the position and the
+// directory are empty.
+type Unmarshaler interface {
+	UnmarshalCurly(v Value) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// A ConvertFunc converts the text of a value to a value of the type it
+// was registered for. Quoted strings are unquoted first. The result
+// must be assignable to that type.
+type ConvertFunc func(s string) (interface{}, error)
+
+// Converters for all parsers.
+var converters struct {
+	sync.RWMutex
+	m	map[reflect.Type]ConvertFunc
+}
+
+// RegisterConverter teaches all parsers how to read values of type t,
+// for example a type from another package:
+//
+//	curlyconf.RegisterConverter(reflect.TypeOf(vendor.RateLimit{}),
+//		func(s string) (interface{}, error) {
+//			return vendor.ParseRateLimit(s)
+//		})
+//
+// A registered type is always a value, never a section. A converter
+// is used before the built-in conversions, so it can also replace
+// those. Register the type itself, not a pointer to it; a field
+// that is a pointer or a slice works as usual. If fn is nil, the
+// converter for t is removed.
+//
+// RegisterConverter is safe for concurrent use, but it is best called
+// from an init function. Marshal does not use converters: the type
+// needs a MarshalText method to be written.
+func RegisterConverter(t reflect.Type, fn ConvertFunc) {
+	converters.Lock()
+	defer converters.Unlock()
+	if fn == nil {
+		delete(converters.m, t)
+		return
+	}
+	if converters.m == nil {
+		converters.m = map[reflect.Type]ConvertFunc{}
+	}
+	converters.m[t] = fn
+}
+
+// RegisterConverter is like the package-level RegisterConverter, but
+// only for this parser. It takes precedence over converters that are
+// registered for all parsers.
+func (p *Parser) RegisterConverter(t reflect.Type, fn ConvertFunc) {
+	if fn == nil {
+		delete(p.conv.convs, t)
+		return
+	}
+	if p.conv.convs == nil {
+		p.conv.convs = map[reflect.Type]ConvertFunc{}
+	}
+	p.conv.convs[t] = fn
+}
+
+//
+//	Find the converter for a type, if any.
+//
+func (c *convContext) converter(t reflect.Type) (fn ConvertFunc) {
+	if c != nil && c.convs[t] != nil {
+		return c.convs[t]
+	}
+	converters.RLock()
+	fn = converters.m[t]
+	converters.RUnlock()
+	return
+}
+
+//
+//	Is this type a single value?
+//
+func (c *convContext) canSet(t reflect.Type) bool {
+	return c.converter(t) != nil || canSetValue(t)
+}
+
+//
+//	Is this type a section?
+//
+func (c *convContext) isSection(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !c.canSet(t)
+}
+
+//
+//	Set a value with a converter.
+//
+func setConverted(val reflect.Value, s string, fn ConvertFunc) (err error) {
+	if s, err = unquote(s); err != nil {
+		return
+	}
+	r, err := fn(s)
+	if err != nil {
+		return
+	}
+	v := reflect.ValueOf(r)
+	if !v.IsValid() || !v.Type().AssignableTo(val.Type()) {
+		return fmt.Errorf("converter for %s returned a %T", val.Type(), r)
+	}
+	val.Set(v)
+	return
+}
+
+//
+//	The Value for string s from token tok. If s is not the text of
+//	the token (it had variables, or it is a default value and there
+//	is no token) the classes are those of s.
+//
+func valueOf(s string, tok *tokInfo) (v Value) {
+	if tok != nil && string(tok.Value) == s {
+		return *newValue(tok)
+	}
+	v = Value{ Text: s, Raw: s }
+	if u, err := unquote(s); err == nil {
+		v.Text = u
+	}
+	t := newtokenizer([]byte(s), tokdef)
+	if st := t.Next(); len(st.Value) == len(s) && st.Token & tokValue != 0 {
+		v.Class = newValue(st).Class
+	}
+	if tok != nil {
+		tv := newValue(tok)
+		v.Start, v.Stop, v.Dir = tv.Start, tv.Stop, tv.Dir
+	}
+	return
+}
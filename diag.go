@@ -0,0 +1,131 @@
+//
+//	Diagnostics: the errors collected by the parser, with
+//	their position in the configuration file.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity of a diagnostic.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+		case SeverityError:
+			return "error"
+		case SeverityWarning:
+			return "warning"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// Codes that classify diagnostics.
+const (
+	CodeSyntax		= "syntax"		// parse error
+	CodeUnknownField	= "unknown-field"	// no such field in the struct
+	CodeSection		= "section"		// cannot start section
+	CodeValue		= "value"		// cannot convert value
+	CodeRequired		= "required"		// required field not set
+	CodeConstraint		= "constraint"		// value not allowed by the cc tag
+	CodeValidate		= "validate"		// Validate method failed
+	CodeVariable		= "variable"		// undefined variable
+	CodeOverride		= "override"		// bad override path or value
+	CodeInclude		= "include"		// cannot include file
+	CodeIO			= "io"			// cannot read file
+	CodeTooMany		= "too-many-errors"
+)
+
+// A Span is a range in a file: from Start up to (not including) End.
+type Span struct {
+	Start	Position
+	End	Position
+}
+
+// A position related to a diagnostic, for example the include
+// statements that led to the file that has the error.
+type Related struct {
+	Pos	Position
+	Message	string
+}
+
+// A Diagnostic is a single error, with the place where it was found.
+type Diagnostic struct {
+	File		string		// empty if not related to a file
+	Span		Span		// position of the token
+	Token		string		// text of the token
+	Message		string
+	Severity	Severity
+	Code		string
+	Related		[]Related
+	Err		error		// underlying error, if any
+	detail		[]string
+}
+
+// Returns the diagnostic as a one-line error.
+func (d *Diagnostic) Error() string {
+	if d.File == "" {
+		return d.Message
+	}
+	s := fmt.Sprintf("%s:%d.%d: %s", d.File,
+		d.Span.Start.Line, d.Span.Start.Column, d.Message)
+	var incl []string
+	for _, r := range d.Related {
+		if r.Message == "included from" {
+			incl = append(incl, fmt.Sprintf("%s:%d", r.Pos.File, r.Pos.Line))
+		}
+	}
+	if len(incl) > 0 {
+		s += " (included from " + strings.Join(incl, ", ") + ")"
+	}
+	return s
+}
+
+// Returns the diagnostic as multiple lines: the include chain, the
+// error, the line in the file and a marker under the token.
+func (d *Diagnostic) LongError() string {
+	if len(d.detail) == 0 {
+		return d.Error()
+	}
+	return strings.Join(d.detail, "\n")
+}
+
+// Returns the underlying error.
+func (d *Diagnostic) Unwrap() error {
+	return d.Err
+}
+
+//
+//	Make a diagnostic for an error at token t (which can be nil).
+//
+func newDiagnostic(t *tokInfo, code, msg string, err error) (d *Diagnostic) {
+	d = &Diagnostic{
+		Message: msg,
+		Severity: SeverityError,
+		Code: code,
+		Err: err,
+	}
+	if t == nil {
+		d.detail = []string{ msg }
+		return
+	}
+	d.File = t.tkz.file
+	d.Span = Span{ Start: t.Position(), End: t.EndPosition() }
+	d.Token = string(t.Value)
+	for inc := t.tkz.incl; inc != nil; inc = inc.tkz.incl {
+		d.Related = append(d.Related, Related{
+			Pos: inc.Position(),
+			Message: "included from",
+		})
+	}
+	d.detail = t.Error(msg)
+	return
+}
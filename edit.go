@@ -0,0 +1,463 @@
+//
+//	Edit a configuration file, keeping comments and layout.
+//
+//	The Editor works on the syntax tree (see ParseAST). Changes
+//	are made to the text of the file, so everything that is not
+//	changed stays exactly as it was.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// An Editor changes statements in a configuration file.
+//
+// Statements and sections are addressed by a path: the keywords
+// and section names leading to it, separated by spaces, for example
+// "person snoopy address". Flattened sections ("person snoopy
+// address 5.6.7.8;") are found the same way as sections with a block.
+type Editor struct {
+	file		string
+	parserType	int
+	data		[]byte
+	doc		*Document
+	expandVars	bool
+}
+
+// Returns an editor for a configuration file.
+func NewEditor(file string, parserType int) (e *Editor, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	e = &Editor{ file: file, parserType: parserType }
+	err = e.load(data)
+	return
+}
+
+// Like NewEditor, but edits a string instead of a file.
+func NewEditorFromString(data string, parserType int) (e *Editor, err error) {
+	e = &Editor{ file: `[internal]`, parserType: parserType }
+	err = e.load([]byte(data))
+	return
+}
+
+//
+//	(Re)parse the data.
+//
+func (e *Editor) load(data []byte) (err error) {
+	p, err := NewParserFromString(string(data), e.parserType)
+	if err != nil {
+		return
+	}
+	p.tok.file = e.file
+	doc, err := p.ParseAST()
+	if err != nil {
+		return
+	}
+	e.data = data
+	e.doc = doc
+	return
+}
+
+// SetExpandVars makes the editor write a ${ in a value as $${, for
+// a Parser that has SetExpandVars on.
+func (e *Editor) SetExpandVars(on bool) {
+	e.expandVars = on
+}
+
+// Returns the syntax tree of the current contents.
+func (e *Editor) Document() *Document {
+	return e.doc
+}
+
+// Returns the current contents.
+func (e *Editor) Bytes() []byte {
+	return e.data
+}
+
+// Write the current contents to a file. The file gets the mode
+// of the file the editor was opened with, or 0644.
+func (e *Editor) WriteFile(file string) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(e.file); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	return ioutil.WriteFile(file, e.data, mode)
+}
+
+// A change of the data: replace data[start:end] with text.
+type edit struct {
+	start	int
+	end	int
+	text	string
+}
+
+//
+//	Apply edits (sorted by offset, not overlapping) and reparse.
+//
+func (e *Editor) apply(edits ...edit) (err error) {
+	data := e.data
+	for i := len(edits) - 1; i >= 0; i-- {
+		ed := edits[i]
+		n := make([]byte, 0, len(data) + len(ed.text))
+		n = append(n, data[:ed.start]...)
+		n = append(n, ed.text...)
+		n = append(n, data[ed.end:]...)
+		data = n
+	}
+	if err = e.load(data); err != nil {
+		err = fmt.Errorf("curlyconf: edit results in invalid file: %s", err)
+	}
+	return
+}
+
+// A node found by a path.
+type match struct {
+	node	Node
+	used	int		// number of values that are part of the path
+}
+
+//
+//	Keyword and values of a node.
+//
+func nodeWords(n Node) (words []string) {
+	var args []*Value
+	switch n := n.(type) {
+		case *Statement:
+			words, args = []string{ n.Key }, n.Values
+		case *Section:
+			words, args = []string{ n.Key }, n.Args
+	}
+	for _, v := range args {
+		words = append(words, v.Text)
+	}
+	return
+}
+
+func hasPrefix(s, prefix []string) bool {
+	if len(prefix) > len(s) {
+		return false
+	}
+	for i := range prefix {
+		if s[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//
+//	Find all nodes that are at or below "path".
+//
+func findNodes(nodes []Node, path []string) (r []match) {
+	for _, n := range nodes {
+		words := nodeWords(n)
+		if hasPrefix(words, path) {
+			r = append(r, match{ node: n, used: len(path) - 1 })
+			continue
+		}
+		if sec, ok := n.(*Section); ok && hasPrefix(path, words) {
+			r = append(r, findNodes(sec.Body, path[len(words):])...)
+		}
+	}
+	return
+}
+
+//
+//	Find the innermost section with a block that contains "path".
+//	Returns the section (nil for the document) and the rest of the path.
+//
+func findBlock(nodes []Node, path []string) (sec *Section, rest []string) {
+	rest = path
+	for _, n := range nodes {
+		s, ok := n.(*Section)
+		if !ok {
+			continue
+		}
+		words := nodeWords(s)
+		if len(words) < len(path) && hasPrefix(path, words) {
+			if sub, r := findBlock(s.Body, path[len(words):]); sub != nil {
+				sec, rest = sub, r
+			} else {
+				sec, rest = s, path[len(words):]
+			}
+		}
+	}
+	return
+}
+
+// Set the values of the statement at path. If the statement occurs
+// more than once (a list, or a section that is written more than
+// once) the first one is changed and the others are deleted, so
+// that the values are what the file has after the change. If it
+// does not exist, it is added. It is an error if path is a section.
+func (e *Editor) Set(path string, values ...string) error {
+	words := strings.Fields(path)
+	var edits []edit
+	for _, m := range findNodes(e.doc.Body, words) {
+		st, ok := m.node.(*Statement)
+		if !ok || !e.isValueList(st, m.used) {
+			return fmt.Errorf("curlyconf: %s is a section", path)
+		}
+		if edits == nil {
+			edits = append(edits, e.setEdit(st, m.used, values))
+		} else {
+			edits = append(edits, e.deleteEdit(st))
+		}
+	}
+	if edits == nil {
+		return e.Add(path, values...)
+	}
+	return e.apply(edits...)
+}
+
+//
+//	Are the values of st after the first "used" ones a list of
+//	values? If two of them are not separated by a comma, the
+//	statement is a flattened section below the path.
+//
+func (e *Editor) isValueList(st *Statement, used int) bool {
+	for i := used + 1; i < len(st.Values); i++ {
+		sep := e.data[st.Values[i - 1].Stop.Offset:st.Values[i].Start.Offset]
+		if !strings.Contains(string(sep), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+//
+//	Replace the values of st after the first "used" ones.
+//
+func (e *Editor) setEdit(st *Statement, used int, values []string) edit {
+	text := e.formatValues(values)
+	if used < len(st.Values) {
+		return edit{
+			start: st.Values[used].Start.Offset,
+			end: st.Values[len(st.Values) - 1].Stop.Offset,
+			text: text,
+		}
+	}
+	end := st.KeyPos.Offset + len(st.Key)
+	if len(st.Values) > 0 {
+		end = st.Values[len(st.Values) - 1].Stop.Offset
+	}
+	if text != "" {
+		text = " " + text
+	}
+	return edit{ start: end, end: end, text: text }
+}
+
+// Add a statement at path. If the path is inside a section that
+// has a block, the statement is added at the end of the block. If
+// the section only exists in flattened form, a new flattened
+// statement is added after it. Otherwise the statement is added
+// at the end of the file in flattened form. To add a section with
+// a block, use AddSection.
+func (e *Editor) Add(path string, values ...string) error {
+	words := strings.Fields(path)
+	if len(words) == 0 {
+		return fmt.Errorf("curlyconf: empty path")
+	}
+	return e.insert(words, func(rest []string) []string {
+		stmt := strings.Join(rest, " ")
+		if v := e.formatValues(values); v != "" {
+			stmt += " " + v
+		}
+		if e.parserType == ParserSemi {
+			stmt += ";"
+		}
+		return []string{ stmt }
+	})
+}
+
+// AddSection adds an empty section with a block at path, for example
+// "person lucy", where Add would add a statement. The section is
+// added in the same place as Add would add a statement. It is an
+// error if the section already has a block.
+//
+// In the ParserDiablo format an empty section can only be added
+// where it cannot be mistaken for the statement before it, otherwise
+// an error is returned; use Add with a path into the section then.
+func (e *Editor) AddSection(path string) error {
+	words := strings.Fields(path)
+	if len(words) == 0 {
+		return fmt.Errorf("curlyconf: empty path")
+	}
+	if e.findSection(words) != nil {
+		return fmt.Errorf("curlyconf: section %s already exists", path)
+	}
+	old := e.data
+	err := e.insert(words, func(rest []string) []string {
+		hdr := strings.Join(rest, " ")
+		switch e.parserType {
+			case ParserDiablo:
+				return []string{ hdr, "end" }
+			default:
+				return []string{ hdr + " {", "}" }
+		}
+	})
+	if err == nil && e.findSection(words) == nil {
+		err = fmt.Errorf("curlyconf: cannot add an empty section %s here", path)
+		e.load(old)
+	}
+	return err
+}
+
+//
+//	The section with a block at exactly path.
+//
+func (e *Editor) findSection(words []string) *Section {
+	for _, m := range findNodes(e.doc.Body, words) {
+		if s, ok := m.node.(*Section); ok && len(nodeWords(s)) == m.used + 1 {
+			return s
+		}
+	}
+	return nil
+}
+
+//
+//	Insert the lines returned by text (for the part of the path
+//	that is not a section with a block) at the place for path.
+//
+func (e *Editor) insert(words []string, text func(rest []string) []string) error {
+	sec, rest := findBlock(e.doc.Body, words)
+	body := e.doc.Body
+	if sec != nil {
+		body = sec.Body
+	}
+
+	// Add after the last statement that shares most of the path.
+	var after Node
+	best := 0
+	for _, n := range body {
+		w := nodeWords(n)
+		l := 0
+		for l < len(w) && l < len(rest) - 1 && w[l] == rest[l] {
+			l++
+		}
+		if l > 0 && l >= best {
+			after, best = n, l
+		}
+	}
+	if after == nil && len(body) > 0 {
+		after = body[len(body) - 1]
+	}
+
+	lines := text(rest)
+
+	var at int
+	var indent string
+	switch {
+		case after != nil:
+			at = e.lineEnd(after.End().Offset - 1)
+			indent = e.indent(after.Pos().Offset)
+		case sec != nil:
+			at = e.lineStart(sec.Close.Offset)
+			indent = e.indent(sec.KeyPos.Offset) + "\t"
+		default:
+			at = len(e.data)
+	}
+	if sec != nil && at > sec.Close.Offset {
+		// the end of the block is on the same line: put it on a
+		// line of its own, after the new lines.
+		if sec.Open.Line == sec.Close.Line {
+			indent = e.indent(sec.KeyPos.Offset) + "\t"
+		}
+		start := sec.Close.Offset
+		for start > 0 && (e.data[start - 1] == ' ' || e.data[start - 1] == '\t') {
+			start--
+		}
+		t := "\n" + indent + strings.Join(lines, "\n" + indent) +
+			"\n" + e.indent(sec.KeyPos.Offset)
+		return e.apply(edit{ start: start, end: sec.Close.Offset, text: t })
+	}
+	t := indent + strings.Join(lines, "\n" + indent) + "\n"
+	if at > 0 && e.data[at - 1] != '\n' {
+		t = "\n" + t
+	}
+	return e.apply(edit{ start: at, end: at, text: t })
+}
+
+// Delete all statements and sections at path. For a section
+// this includes the flattened statements for that section.
+func (e *Editor) Delete(path string) error {
+	words := strings.Fields(path)
+	var edits []edit
+	for _, m := range findNodes(e.doc.Body, words) {
+		edits = append(edits, e.deleteEdit(m.node))
+	}
+	if len(edits) == 0 {
+		return fmt.Errorf("curlyconf: %s not found", path)
+	}
+	return e.apply(edits...)
+}
+
+//
+//	Remove node n, and the whole line if nothing else is on it.
+//
+func (e *Editor) deleteEdit(n Node) edit {
+	start := n.Pos().Offset
+	end := n.End().Offset
+	ls := e.lineStart(start)
+	le := e.lineEnd(end - 1)
+	after := strings.TrimSpace(string(e.data[end:le]))
+	if strings.TrimSpace(string(e.data[ls:start])) == "" &&
+	   (after == "" || after[0] == '#' || strings.HasPrefix(after, "//")) {
+		// the whole line, including a comment after the node.
+		start, end = ls, le
+	}
+	return edit{ start: start, end: end }
+}
+
+//
+//	Start of the line that contains offset.
+//
+func (e *Editor) lineStart(offset int) int {
+	for offset > 0 && e.data[offset - 1] != '\n' {
+		offset--
+	}
+	return offset
+}
+
+//
+//	Offset after the newline at or after offset.
+//
+func (e *Editor) lineEnd(offset int) int {
+	if offset < 0 {
+		offset = 0
+	}
+	for offset < len(e.data) && e.data[offset] != '\n' {
+		offset++
+	}
+	if offset < len(e.data) {
+		offset++
+	}
+	return offset
+}
+
+//
+//	Indentation of the line that contains offset.
+//
+func (e *Editor) indent(offset int) string {
+	s := e.lineStart(offset)
+	i := s
+	for i < len(e.data) && (e.data[i] == ' ' || e.data[i] == '\t') {
+		i++
+	}
+	return string(e.data[s:i])
+}
+
+func (e *Editor) formatValues(values []string) string {
+	var r []string
+	for _, v := range values {
+		r = append(r, escapeVars(formatText(v), e.expandVars))
+	}
+	return strings.Join(r, ", ")
+}
@@ -0,0 +1,481 @@
+//
+//	Write Go structs as a configuration file, using reflection.
+//
+//	This is the inverse of structWriter. Fields are matched
+//	with the same rules, so that the output reads back into
+//	the same structure.
+//
+
+package curlyconf
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Encoder writes a struct as a configuration file.
+type Encoder struct {
+	w		io.Writer
+	indent		string
+	stmtEnd		string
+	sectionStart	string
+	sectionEnd	string
+	sources		Sources		// for comments, see SetSources
+	expandVars	bool		// write ${ as $${
+}
+
+// Returns a new encoder that writes to w, in the syntax
+// of parserType (ParserSemi, ParserNL or ParserDiablo).
+func NewEncoder(w io.Writer, parserType int) *Encoder {
+	e := &Encoder{
+		w: w,
+		indent: "\t",
+		stmtEnd: ";",
+		sectionStart: " {",
+		sectionEnd: "}",
+	}
+	switch parserType {
+		case ParserNL:
+			e.stmtEnd = ""
+		case ParserDiablo:
+			e.stmtEnd = ""
+			e.sectionStart = ""
+			e.sectionEnd = "end"
+	}
+	return e
+}
+
+// Set the string used to indent the contents of a section,
+// the default is a single tab.
+func (e *Encoder) SetIndent(indent string) {
+	e.indent = indent
+}
+
+// SetExpandVars makes the encoder write a ${ in a value as $${, for a
+// Parser that has SetExpandVars on. Without it, a ${ is written as is.
+func (e *Encoder) SetExpandVars(on bool) {
+	e.expandVars = on
+}
+
+// Encode writes the struct v (or pointer to struct) to the
+// underlying writer.
+//
+// Fields that have the zero value, nil pointers and empty slices
+// are not written, unless the field has a default. Elements of a
+// map are written even if they are zero. A field called Name_ is written as the name
+// of the section. Slices of values are written as a comma
+// separated list, slices of structs as repeated sections.
+func (e *Encoder) Encode(v interface{}) (err error) {
+	val := reflect.Indirect(reflect.ValueOf(v))
+	if val.Kind() != reflect.Struct {
+		return fmt.Errorf("curlyconf: cannot marshal %T, not a struct", v)
+	}
+	var buf bytes.Buffer
+	if err = e.encodeStruct(&buf, val, "", ""); err != nil {
+		return
+	}
+	_, err = e.w.Write(buf.Bytes())
+	return
+}
+
+// Marshal returns the configuration file for struct v, in the
+// syntax of parserType. See Encoder.Encode.
+func Marshal(v interface{}, parserType int) ([]byte, error) {
+	var buf bytes.Buffer
+	err := NewEncoder(&buf, parserType).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//
+//	Write all fields of a struct. path is the path of the struct,
+//	as in structWriter.
+//
+func (e *Encoder) encodeStruct(buf *bytes.Buffer, val reflect.Value, path, indent string) (err error) {
+	tp := val.Type()
+	for i := 0; i < tp.NumField(); i++ {
+		// skip if first letter is not uppercase
+		sf := tp.Field(i)
+		name := sf.Name
+		if name[:1] != strings.ToUpper(name[:1]) || name == "Name_" {
+			continue
+		}
+		name = strings.ToLower(name)
+		fv := val.Field(i)
+		tag := parseTag(sf)
+		if fv.Kind() != reflect.Ptr && fv.IsZero() && !tag.hasDef {
+			continue
+		}
+		var kw string
+		if kw, err = e.keyword(name, tag); err != nil {
+			return
+		}
+
+		// A zero value must be written if it is not the default.
+		if tag.hasDef && fv.IsZero() && canSetValue(fv.Type()) {
+			s, err := e.formatValue(fv)
+			if err != nil {
+				return fmt.Errorf("curlyconf: field %s: %s", name, err)
+			}
+			fmt.Fprintf(buf, "%s%s %s%s%s\n", indent, kw, s, e.stmtEnd,
+					e.comment(joinPath(path, name)))
+			continue
+		}
+		if fv.Kind() != reflect.Ptr && fv.IsZero() {
+			continue
+		}
+		if err = e.encodeField(buf, kw, fv, joinPath(path, name), indent); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//
+//	The keyword to write for a field. include (and set, if variables
+//	are expanded) would be read as a statement, so then an alias from
+//	the cc tag is used.
+//
+func (e *Encoder) keyword(name string, tag *fieldTag) (string, error) {
+	if !e.reserved(name) {
+		return name, nil
+	}
+	for _, n := range tag.names {
+		if !e.reserved(n) {
+			return n, nil
+		}
+	}
+	return "", fmt.Errorf("curlyconf: field %s: %s is a keyword, " +
+			"add another name in the cc tag", name, name)
+}
+
+func (e *Encoder) reserved(name string) bool {
+	return name == "include" || (name == "set" && e.expandVars)
+}
+
+//
+//	Write one field, as a statement or as a section. Zero values
+//	are written too; the caller skips those if it wants.
+//
+func (e *Encoder) encodeField(buf *bytes.Buffer, name string, val reflect.Value, path, indent string) (err error) {
+
+	// A pointer that is not nil is always written.
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return
+		}
+		val = val.Elem()
+	}
+
+	elemType := val.Type()
+	list := elemType.Kind() == reflect.Slice && !canSetValue(elemType)
+	if list {
+		if val.Len() == 0 {
+			// there is no syntax for an empty list.
+			return
+		}
+		elemType = elemType.Elem()
+	}
+
+	// A map of sections or a section with key/value statements.
+	if val.Kind() == reflect.Map && !canSetValue(val.Type()) {
+		return e.encodeMap(buf, name, val, path, indent)
+	}
+
+	// A section, or a list of sections.
+	if !canSetValue(elemType) && elemType.Kind() == reflect.Struct {
+		if !list {
+			return e.encodeSection(buf, name, val, path, indent)
+		}
+		for i := 0; i < val.Len(); i++ {
+			ev := val.Index(i)
+			err = e.encodeSection(buf, name, ev, elemPath(path, val, i), indent)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	// A value, or a list of values.
+	var values []string
+	if list {
+		for i := 0; i < val.Len(); i++ {
+			s, err := e.formatValue(val.Index(i))
+			if err != nil {
+				return fmt.Errorf("curlyconf: field %s: %s", name, err)
+			}
+			values = append(values, s)
+		}
+	} else {
+		s, err := e.formatValue(val)
+		if err != nil {
+			return fmt.Errorf("curlyconf: field %s: %s", name, err)
+		}
+		values = append(values, s)
+	}
+	fmt.Fprintf(buf, "%s%s %s%s%s\n", indent, name,
+			strings.Join(values, ", "), e.stmtEnd, e.comment(path))
+	return
+}
+
+//
+//	Write a map. If the elements are structs, each element is
+//	a section with the key as the name. Otherwise the map is a
+//	section with a "key value" statement for each element.
+//
+func (e *Encoder) encodeMap(buf *bytes.Buffer, name string, val reflect.Value, path, indent string) (err error) {
+
+	type entry struct {
+		key	string
+		path	string
+		val	reflect.Value
+	}
+	var entries []entry
+	iter := val.MapRange()
+	for iter.Next() {
+		k, err := e.formatValue(iter.Key())
+		if err != nil {
+			return fmt.Errorf("curlyconf: field %s: %s", name, err)
+		}
+		// copy, so that the value is addressable.
+		v := reflect.New(iter.Value().Type()).Elem()
+		v.Set(iter.Value())
+		epath := fmt.Sprintf("%s[%v]", path, iter.Key().Interface())
+		entries = append(entries, entry{ k, epath, v })
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	elemType := val.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if !canSetValue(elemType) && elemType.Kind() == reflect.Struct {
+		for _, en := range entries {
+			v := en.val
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					continue
+				}
+				v = v.Elem()
+			}
+			err = e.encodeBlock(buf, name + " " + en.key, v, en.path, indent)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	if elemType.Kind() == reflect.Map && !canSetValue(elemType) {
+		return fmt.Errorf("curlyconf: field %s: maps of maps are not supported", name)
+	}
+
+	fmt.Fprintf(buf, "%s%s%s%s\n", indent, name, e.sectionStart, e.comment(path))
+	for _, en := range entries {
+		if !identRegexp.MatchString(en.key) {
+			return fmt.Errorf("curlyconf: field %s: key %s is not an identifier",
+						name, en.key)
+		}
+		if e.reserved(en.key) {
+			return fmt.Errorf("curlyconf: field %s: key %s is a keyword",
+						name, en.key)
+		}
+		err = e.encodeField(buf, en.key, en.val, en.path, indent + e.indent)
+		if err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(buf, "%s%s\n", indent, e.sectionEnd)
+	return
+}
+
+//
+//	Write a struct as a section.
+//
+func (e *Encoder) encodeSection(buf *bytes.Buffer, name string, val reflect.Value, path, indent string) (err error) {
+	hdr := name
+	if n := val.FieldByName("Name_"); n.IsValid() {
+		hdr += " " + e.escape(formatString(n.String()))
+	}
+	return e.encodeBlock(buf, hdr, val, path, indent)
+}
+
+//
+//	Write the header and contents of a section.
+//
+func (e *Encoder) encodeBlock(buf *bytes.Buffer, hdr string, val reflect.Value, path, indent string) (err error) {
+	fmt.Fprintf(buf, "%s%s%s%s\n", indent, hdr, e.sectionStart, e.comment(path))
+	if err = e.encodeStruct(buf, val, path, indent + e.indent); err != nil {
+		return
+	}
+	fmt.Fprintf(buf, "%s%s\n", indent, e.sectionEnd)
+	return
+}
+
+var identRegexp = regexp.MustCompile(`^` + re_ident + `$`)
+
+//
+//	Quote a string, unless it's a simple identifier.
+//
+func formatString(s string) string {
+	if s != "end" && identRegexp.MatchString(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+//
+//	Write a ${ as $${ if variables are expanded, otherwise it would
+//	be read back as a variable. s is a formatted value; unquoted
+//	values never contain a ${ (see formatText).
+//
+func escapeVars(s string, on bool) string {
+	if !on {
+		return s
+	}
+	return strings.ReplaceAll(s, "${", "$${")
+}
+
+func (e *Encoder) escape(s string) string {
+	return escapeVars(s, e.expandVars)
+}
+
+//
+//	Format a single value, as formatValue.
+//
+func (e *Encoder) formatValue(val reflect.Value) (s string, err error) {
+	s, err = formatValue(val)
+	return e.escape(s), err
+}
+
+//
+//	Format a single value. This is the inverse of setValue.
+//	Strings are quoted unless they are identifiers, everything
+//	else goes through formatText.
+//
+func formatValue(val reflect.Value) (s string, err error) {
+	if val.Kind() == reflect.String && !implementsText(val) {
+		return formatString(val.String()), nil
+	}
+	if s, err = valueText(val); err == nil {
+		s = formatText(s)
+	}
+	return
+}
+
+func implementsText(val reflect.Value) bool {
+	var intf interface{}
+	if val.CanAddr() {
+		intf = val.Addr().Interface()
+	} else {
+		intf = val.Interface()
+	}
+	_, m := intf.(encoding.TextMarshaler)
+	_, u := intf.(encoding.TextUnmarshaler)
+	return m || u
+}
+
+//
+//	The text of a value, not quoted.
+//
+func valueText(val reflect.Value) (s string, err error) {
+
+	// If the type complies with the TextMarshaler interface, use it.
+	var intf interface{}
+	if val.CanAddr() {
+		intf = val.Addr().Interface()
+	} else {
+		intf = val.Interface()
+	}
+	if obj, ok := intf.(encoding.TextMarshaler); ok {
+		var b []byte
+		if b, err = obj.MarshalText(); err == nil {
+			s = string(b)
+		}
+		return
+	}
+	if _, ok := intf.(encoding.TextUnmarshaler); ok {
+		err = fmt.Errorf("type %s has no MarshalText method",
+					val.Type().String())
+		return
+	}
+
+	// Special support for some types
+	switch v := val.Interface().(type) {
+		case net.TCPAddr:
+			return v.String(), nil
+		case net.IPAddr:
+			return v.String(), nil
+		case net.IPNet:
+			return v.String(), nil
+		case net.UDPAddr:
+			return v.String(), nil
+		case net.UnixAddr:
+			return v.Name, nil
+		case net.HardwareAddr:
+			return v.String(), nil
+		case url.URL:
+			return v.String(), nil
+		case mail.Address:
+			return v.String(), nil
+		case fs.FileMode:
+			return formatFileMode(v), nil
+		case time.Duration:
+			return v.String(), nil
+	}
+
+	switch val.Kind() {
+		case reflect.Bool:
+			s = strconv.FormatBool(val.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16,
+		     reflect.Int32, reflect.Int64:
+			s = strconv.FormatInt(val.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16,
+		     reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			s = strconv.FormatUint(val.Uint(), 10)
+		case reflect.Float32, reflect.Float64:
+			s = strconv.FormatFloat(val.Float(), 'f', -1, val.Type().Bits())
+		case reflect.Complex64, reflect.Complex128:
+			s = strconv.FormatComplex(val.Complex(), 'f', -1, val.Type().Bits())
+		case reflect.Slice:
+			// []byte, as base64 (never hex: that needs a prefix)
+			s = base64.StdEncoding.EncodeToString(val.Bytes())
+		case reflect.String:
+			s = val.String()
+		default:
+			err = fmt.Errorf("unsupported type %s", val.Type().String())
+	}
+	return
+}
+
+//
+//	A value is written as-is if it is a single value token without
+//	variables that is not a quoted string itself, otherwise it is
+//	quoted. So "+Inf" and "fe80::1%eth0" are quoted.
+//
+func formatText(s string) string {
+	t := newtokenizer([]byte(s), tokdef)
+	tok := t.Next()
+	if (tok.Token & tokValue) != 0 && len(tok.Value) == len(s) &&
+	   s[0] != '"' && s != "end" && !strings.Contains(s, "${") {
+		return s
+	}
+	return strconv.Quote(s)
+}
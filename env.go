@@ -0,0 +1,82 @@
+//
+//	Environment variables.
+//
+//	${env:NAME}		the value of NAME; an error if it is not set
+//	${env:NAME:-default}	default if NAME is not set or empty
+//	${env:NAME:?message}	an error with message if NAME is not set or empty
+//
+//	This must be enabled with Parser.AllowEnv, which also says
+//	which variables a configuration file may read.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// AllowEnv lets the configuration read the environment variables that
+// match one of the patterns, with ${env:NAME}. The patterns are as for
+// path.Match: "APP_*" allows all variables that start with APP_, "*"
+// allows all. Without AllowEnv, ${env:...} is an error. AllowEnv
+// turns on SetExpandVars.
+func (p *Parser) AllowEnv(patterns ...string) {
+	for _, pat := range patterns {
+		if _, err := path.Match(pat, ""); err != nil {
+			panic("curlyconf: AllowEnv: bad pattern " + pat)
+		}
+	}
+	p.expandVars = true
+	p.envAllow = append(p.envAllow, patterns...)
+}
+
+//
+//	Is the configuration allowed to read this variable?
+//
+func (p *Parser) envAllowed(name string) bool {
+	for _, pat := range p.envAllow {
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//
+//	The value of ${env:...}; s is what comes after "env:".
+//
+func (p *Parser) envValue(s string) (v string, err error) {
+	name, op, arg := s, "", ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, op = s[:i], s[i:]
+		if len(op) >= 2 {
+			op, arg = s[i:i+2], s[i+2:]
+		}
+		if op != ":-" && op != ":?" {
+			return "", fmt.Errorf("invalid ${env:%s}, expected :- or :?", s)
+		}
+	}
+	if len(p.envAllow) == 0 {
+		return "", fmt.Errorf("environment variable %s: " +
+			"environment variables are not enabled", name)
+	}
+	if !p.envAllowed(name) {
+		return "", fmt.Errorf("environment variable %s is not allowed", name)
+	}
+	v, set := os.LookupEnv(name)
+	switch {
+		case op == ":-" && v == "":
+			v = arg
+		case op == ":?" && v == "":
+			if arg == "" {
+				arg = "not set"
+			}
+			err = fmt.Errorf("environment variable %s: %s", name, arg)
+		case op == "" && !set:
+			err = fmt.Errorf("environment variable %s is not set", name)
+	}
+	return
+}
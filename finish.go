@@ -0,0 +1,186 @@
+//
+//	After parsing: fill in defaults, check required fields
+//	and the number of values of slices, and call Validate.
+//
+//	The parser remembers which fields of which section were set.
+//	A section can be spread over the file ("person snoopy { .. }"
+//	and later "person snoopy address 5.6.7.8;") so this is done
+//	after the whole file has been read.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// What we know about a section.
+type sectionState struct {
+	tok	*tokInfo		// keyword of the (first) section header
+	seen	map[int]*tokInfo	// fields that were set, and where
+}
+
+//
+//	Get the state of the section at path. tok is its header, if any.
+//
+func (p *Parser) state(path string, tok *tokInfo) (st *sectionState) {
+	if p.sections == nil {
+		p.sections = map[string]*sectionState{}
+	}
+	st = p.sections[path]
+	if st == nil {
+		st = &sectionState{ tok: tok, seen: map[int]*tokInfo{} }
+		p.sections[path] = st
+	}
+	p.recordTok(path, tok)
+	return
+}
+
+//
+//	Remember that a field was set.
+//
+func (p *Parser) markSeen(sw *structWriter, f *structField, tok *tokInfo) {
+	p.mergeField(f)
+	p.recordTok(f.path, tok)
+	if f.index >= 0 {
+		p.state(sw.path, nil).seen[f.index] = tok
+	}
+}
+
+//
+//	Finish a struct and all sections in it.
+//
+func (p *Parser) finish(v reflect.Value, path string) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	st := p.sections[path]
+	tp := v.Type()
+	for i := 0; i < tp.NumField(); i++ {
+		// skip if first letter is not uppercase
+		sf := tp.Field(i)
+		if sf.Name[:1] != strings.ToUpper(sf.Name[:1]) {
+			continue
+		}
+		name := strings.ToLower(sf.Name)
+		tag := parseTag(sf)
+		var seen bool
+		var tok *tokInfo
+		if st != nil {
+			tok, seen = st.seen[i]
+		}
+
+		if !seen && tag.hasDef {
+			sw := &structWriter{ stru: v, path: path, conv: &p.conv }
+			f := sw.fieldAt(i, name)
+			err := f.Set(tag.def)
+			if err == nil {
+				err = tag.check(f.elem)
+			}
+			if err != nil {
+				p.report(nil, CodeValue, fmt.Sprintf(
+					"field %s: invalid default %q: %s",
+					joinPath(path, name), tag.def, err), err)
+			} else {
+				p.record(joinPath(path, name), Source{ Origin: OriginDefault }, false)
+			}
+		}
+
+		if seen || st != nil || path == "" {
+			if err := tag.checkItems(v.Field(i)); err != nil {
+				p.items(st, tok, name, err)
+			}
+		}
+
+		p.finishField(v.Field(i), joinPath(path, name))
+
+		// Required fields must be set, unless the section
+		// itself is not in the file.
+		if !seen && tag.required && (st != nil || path == "") {
+			p.missing(st, name)
+		}
+	}
+
+	// Now the struct is complete, it can check itself.
+	if st != nil || path == "" {
+		p.validate(v, st)
+	}
+}
+
+//
+//	Report a missing required field.
+//
+func (p *Parser) missing(st *sectionState, name string) {
+	msg := "missing required field " + name
+	var tok *tokInfo
+	if st != nil && st.tok != nil {
+		tok = st.tok
+		msg = "section " + string(tok.Value) + ": " + msg
+	} else if len(p.files) > 0 {
+		msg = p.files[0] + ": " + msg
+	}
+	p.report(tok, CodeRequired, msg, nil)
+}
+
+//
+//	Report a slice with too few or too many values, at the
+//	last statement that set it (or the section header).
+//
+func (p *Parser) items(st *sectionState, tok *tokInfo, name string, err error) {
+	msg := "field " + name + " " + err.Error()
+	if tok == nil && st != nil {
+		tok = st.tok
+	}
+	if tok == nil && len(p.files) > 0 {
+		msg = p.files[0] + ": " + msg
+	}
+	p.report(tok, CodeConstraint, msg, err)
+}
+
+//
+//	Finish the sections in a field.
+//
+func (p *Parser) finishField(fv reflect.Value, path string) {
+	t := fv.Type()
+	switch t.Kind() {
+		case reflect.Struct:
+			if p.conv.isSection(t) {
+				p.finish(fv, path)
+			}
+		case reflect.Ptr:
+			if !fv.IsNil() && p.conv.isSection(t.Elem()) {
+				p.finish(fv.Elem(), path)
+			}
+		case reflect.Slice:
+			if p.conv.isSection(t.Elem()) {
+				for j := 0; j < fv.Len(); j++ {
+					e := fv.Index(j)
+					p.finish(e, elemPath(path, fv, j))
+				}
+			}
+		case reflect.Map:
+			if p.conv.canSet(t) {
+				break
+			}
+			et := t.Elem()
+			iter := fv.MapRange()
+			for iter.Next() {
+				epath := fmt.Sprintf("%s[%v]", path, iter.Key().Interface())
+				e := iter.Value()
+				switch {
+					case et.Kind() == reflect.Ptr && p.conv.isSection(et.Elem()):
+						if !e.IsNil() {
+							p.finish(e.Elem(), epath)
+						}
+					case p.conv.isSection(et):
+						// map entries are copies.
+						c := reflect.New(et).Elem()
+						c.Set(e)
+						p.finish(c, epath)
+						fv.SetMapIndex(iter.Key(), c)
+				}
+			}
+	}
+}
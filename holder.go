@@ -0,0 +1,261 @@
+//
+//	Holder: keep the current configuration, and reload it
+//	on a signal or when one of the files changes.
+//
+
+package curlyconf
+
+import (
+	"crypto/sha256"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Holder holds the current configuration of type T, read from a
+// file. Readers call Load, which is lock-free; the configuration
+// it returns must not be changed.
+//
+// Reload reads the file again. If that fails, the old configuration
+// is kept and the error is returned. Watch does this automatically,
+// on a signal (usually SIGHUP) or when the file or one of the files
+// it includes changes.
+type Holder[T any] struct {
+	file		string
+	parserType	int
+	setup		func(p *Parser)
+	cur		atomic.Pointer[T]
+
+	mu		sync.Mutex	// serializes reloads
+	files		map[string]fileStamp
+	subs		[]func(old, new *T)
+	onError		func(err error)
+	stop		chan struct{}
+	sigs		chan os.Signal
+}
+
+// Modification time, size and checksum of a file. If the file was
+// read within mtimeGranularity of its mtime, a change that keeps the
+// size can also keep the mtime (filesystems with 1s granularity,
+// cp -p). Only then the checksum is kept and compared.
+type fileStamp struct {
+	mtime	time.Time
+	size	int64
+	racy	bool
+	sum	[sha256.Size]byte
+}
+
+// The coarsest mtime granularity of the usual filesystems (FAT).
+const mtimeGranularity = 2 * time.Second
+
+// Returns a Holder for a configuration file, and reads it. If setup
+// is not nil, it is called for every new Parser before it parses the
+// file (for example to set options).
+func NewHolder[T any](file string, parserType int, setup func(p *Parser)) (h *Holder[T], err error) {
+	h = &Holder[T]{
+		file: file,
+		parserType: parserType,
+		setup: setup,
+	}
+	if err = h.Reload(); err != nil {
+		h = nil
+	}
+	return
+}
+
+// Returns the current configuration.
+func (h *Holder[T]) Load() *T {
+	return h.cur.Load()
+}
+
+// Subscribe calls fn after every successful reload, with the old and
+// the new configuration. fn is called from the goroutine that reloads;
+// it must not call Reload.
+func (h *Holder[T]) Subscribe(fn func(old, new *T)) {
+	h.mu.Lock()
+	h.subs = append(h.subs, fn)
+	h.mu.Unlock()
+}
+
+// OnError sets a function that is called when a reload started by
+// Watch fails. The old configuration is still in use.
+func (h *Holder[T]) OnError(fn func(err error)) {
+	h.mu.Lock()
+	h.onError = fn
+	h.mu.Unlock()
+}
+
+// Read the configuration file again. If it has errors, the current
+// configuration is kept and the error (usually a *ParseError) is
+// returned.
+func (h *Holder[T]) Reload() (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.reload()
+	return
+}
+
+//
+//	Reload, with the lock held. Returns the files that were read,
+//	also if there was an error.
+//
+func (h *Holder[T]) reload() (files []string, err error) {
+	p, err := NewParser(h.file, h.parserType)
+	if err != nil {
+		files = []string{ h.file }
+		return
+	}
+	if h.setup != nil {
+		h.setup(p)
+	}
+	v := new(T)
+	err = p.Parse(v)
+	files = p.Files()
+	if err != nil {
+		return
+	}
+
+	h.files = map[string]fileStamp{}
+	for _, f := range files {
+		h.files[f] = stamp(f)
+	}
+	old := h.cur.Swap(v)
+	if old != nil {
+		for _, fn := range h.subs {
+			fn(old, v)
+		}
+	}
+	return
+}
+
+//
+//	Stamp a file that is (about to be) read now.
+//
+func stamp(file string) (s fileStamp) {
+	s = statStamp(file)
+	if time.Since(s.mtime) < mtimeGranularity {
+		s.racy = true
+		s.sum = fileSum(file)
+	}
+	return
+}
+
+//
+//	Stamp without the checksum.
+//
+func statStamp(file string) (s fileStamp) {
+	if fi, err := os.Stat(file); err == nil {
+		s = fileStamp{ mtime: fi.ModTime(), size: fi.Size() }
+	}
+	return
+}
+
+func fileSum(file string) (sum [sha256.Size]byte) {
+	if data, err := os.ReadFile(file); err == nil {
+		sum = sha256.Sum256(data)
+	}
+	return
+}
+
+//
+//	Did any of the files change since they were read? The contents
+//	are only read if the mtime and size are the same, and the file
+//	was read too soon after the mtime to trust it.
+//
+func (h *Holder[T]) changed() bool {
+	for f, s := range h.files {
+		n := statStamp(f)
+		if n.mtime != s.mtime || n.size != s.size {
+			return true
+		}
+		if !s.racy {
+			continue
+		}
+		if fileSum(f) != s.sum {
+			return true
+		}
+		if time.Since(s.mtime) >= mtimeGranularity {
+			// a later change would have a new mtime.
+			h.files[f] = n
+		}
+	}
+	return false
+}
+
+// Watch reloads the configuration in the background when one of
+// the signals is received, and (if interval is not 0) when one of
+// the files that were read last time has changed. Files are checked
+// every interval. After a failed reload, the files read by that
+// attempt are watched too. Files that would be matched by an include
+// pattern but did not exist when the configuration was read are not
+// noticed until the next reload.
+//
+// Stop ends watching; after that Watch can be called again.
+func (h *Holder[T]) Watch(interval time.Duration, sig ...os.Signal) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		panic("curlyconf: Holder.Watch called twice")
+	}
+	stop := make(chan struct{})
+	h.stop = stop
+	h.sigs = make(chan os.Signal, 1)
+	if len(sig) > 0 {
+		signal.Notify(h.sigs, sig...)
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		tick = t.C
+		go func() {
+			<-stop
+			t.Stop()
+		}()
+	}
+	go h.watch(stop, h.sigs, tick)
+}
+
+func (h *Holder[T]) watch(stop chan struct{}, sigs chan os.Signal, tick <-chan time.Time) {
+	for {
+		force := false
+		select {
+			case <-stop:
+				return
+			case <-sigs:
+				force = true
+			case <-tick:
+		}
+		h.mu.Lock()
+		if force || h.changed() {
+			if files, err := h.reload(); err != nil {
+				// don't retry a bad file until it changes
+				// again. Also watch the files that were read
+				// this time, the error can be in a new one.
+				for f := range h.files {
+					h.files[f] = stamp(f)
+				}
+				for _, f := range files {
+					h.files[f] = stamp(f)
+				}
+				if h.onError != nil {
+					h.onError(err)
+				}
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Stop watching.
+func (h *Holder[T]) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop == nil {
+		return
+	}
+	signal.Stop(h.sigs)
+	close(h.stop)
+	h.stop = nil
+}
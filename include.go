@@ -0,0 +1,152 @@
+//
+//	The include statement.
+//
+//	include "conf.d/*.conf";
+//
+//	Reads one or more files at the point of the include statement,
+//	as if their contents had been written there, but a statement or
+//	block cannot continue past the end of an included file. Relative
+//	paths are relative to the directory of the including file. The
+//	filename may be a glob pattern; matching files are read in lexical
+//	order, and a pattern that matches nothing is not an error.
+//
+//	With NewParserFS the files are read from the same fs.FS,
+//	and "/" is the root of that filesystem.
+//
+//	"include" is a reserved word: a field called Include, or a
+//	key "include" in a map section, cannot be set from a file.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//
+//	include statement seen, "itok" is the "include" keyword.
+//
+func (p *Parser) include(itok *tokInfo) {
+
+	tok, ok := p.expect(tokValue, "filename")
+	if !ok {
+		p.recover(tok)
+		return
+	}
+	pattern, ok := p.expand(tok, string(tok.Value))
+	if !ok {
+		p.recover(tok)
+		return
+	}
+	if len(pattern) > 0 && pattern[0] == '"' {
+		s, err := strconv.Unquote(pattern)
+		if err == nil {
+			pattern = s
+		}
+	}
+	if end, ok := p.expect(p.stmtEnd, p.stmtEndStr); !ok {
+		p.recover(end)
+		return
+	}
+
+	var files []string
+	var err error
+	if p.fsys != nil {
+		if !path.IsAbs(pattern) {
+			pattern = path.Join(tok.tkz.Dir(), pattern)
+		}
+		pattern = strings.TrimPrefix(path.Clean(pattern), "/")
+		files, err = fs.Glob(p.fsys, pattern)
+	} else {
+		if !filepath.IsAbs(pattern) {
+			if dir := tok.tkz.Dir(); dir != "" {
+				pattern = filepath.Join(dir, pattern)
+			}
+		}
+		files, err = filepath.Glob(pattern)
+	}
+	if err != nil {
+		p.errorErr(tok, CodeInclude, err)
+		return
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, `*?[\`) {
+		// not a pattern, so the file must exist.
+		files = []string{ pattern }
+	}
+
+	var tkz []*tokenizer
+	for _, f := range files {
+		t, err := p.includeFile(itok, f)
+		if err != nil {
+			p.errorErr(tok, CodeInclude, err)
+			continue
+		}
+		tkz = append(tkz, t)
+	}
+	if len(tkz) == 0 {
+		return
+	}
+
+	// Continue with the first file, the others are next in line.
+	p.tokStack = append(p.tokStack, p.tok)
+	for i := len(tkz) - 1; i > 0; i-- {
+		p.tokStack = append(p.tokStack, tkz[i])
+	}
+	p.tok = tkz[0]
+}
+
+//
+//	Open a tokenizer for an included file.
+//
+func (p *Parser) includeFile(itok *tokInfo, file string) (t *tokenizer, err error) {
+
+	abs := file
+	if p.fsys == nil {
+		if abs, err = filepath.Abs(file); err != nil {
+			return
+		}
+	}
+	depth := 0
+	for inc := itok; inc != nil; inc = inc.tkz.incl {
+		if inc.tkz.abs == abs {
+			err = fmt.Errorf("include loop: %s is already being read", file)
+			return
+		}
+		depth++
+	}
+	if depth > p.maxInclude {
+		err = fmt.Errorf("include nesting too deep (max %d)", p.maxInclude)
+		return
+	}
+
+	if p.fsys != nil {
+		t, err = confTokenizerFS(p.fsys, file)
+	} else {
+		t, err = confTokenizer(file)
+	}
+	if err != nil {
+		return
+	}
+	t.SetSpace(p.space)
+	t.incl = itok
+	t.depth = p.depth
+	p.files = append(p.files, file)
+	return
+}
+
+// Set the maximum depth of nested include statements (default 16).
+func (p *Parser) SetMaxIncludeDepth(depth int) {
+	p.maxInclude = depth
+}
+
+// Files returns the names of all files that were read, the main
+// configuration file first, followed by included files in the
+// order they were read.
+func (p *Parser) Files() []string {
+	return p.files
+}
@@ -0,0 +1,622 @@
+//
+//	Scanners for the tokens.
+//
+//	Each scanner returns the length of the token at the start of
+//	b, or 0 if there is none. A scanner matches exactly what the
+//	regular expression in the Match field of its tokDef matches
+//	(the leftmost-first match, as regexp.Find would return it),
+//	including the odd cases, because the token classes depend on
+//	which expressions give the longest match. cc_test.go checks
+//	them against the regular expressions.
+//
+
+package curlyconf
+
+import (
+	"strings"
+)
+
+const (
+	chDigit = "0123456789"
+	chLower = "abcdefghijklmnopqrstuvwxyz"
+	chUpper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	chHex   = chDigit + "abcdefABCDEF"
+	// first bytes of the Kelvin sign and the long s, see hostChar.
+	chFold  = "\xe2\xc5"
+)
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+//
+//	Number of bytes from b[i] on for which f is true.
+//
+func run(b []byte, i int, f func(c byte) bool) (n int) {
+	for i + n < len(b) && f(b[i + n]) {
+		n++
+	}
+	return
+}
+
+//
+//	A literal string.
+//
+func scanLit(lit string) func(b []byte) int {
+	return func(b []byte) int {
+		if len(b) >= len(lit) && string(b[:len(lit)]) == lit {
+			return len(lit)
+		}
+		return 0
+	}
+}
+
+//
+//	Digits, optionally separated by single underscores: \d(_?\d)*
+//	for isDigit. Returns the length, 0 if it does not start with
+//	a digit.
+//
+func digits(b []byte, i int, isDigit func(c byte) bool) (n int) {
+	if i >= len(b) || !isDigit(b[i]) {
+		return 0
+	}
+	n = 1
+	for i + n < len(b) {
+		if isDigit(b[i + n]) {
+			n++
+		} else if b[i + n] == '_' && i + n + 1 < len(b) && isDigit(b[i + n + 1]) {
+			n += 2
+		} else {
+			break
+		}
+	}
+	return
+}
+
+//
+//	Optional sign and k/m/g/t suffix of a number.
+//
+func numSign(b []byte) int {
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		return 1
+	}
+	return 0
+}
+
+func numSuffix(b []byte, i int) int {
+	if i < len(b) {
+		switch b[i] {
+			case 'k', 'K', 'm', 'M', 'g', 'G', 't', 'T':
+				return i + 1
+		}
+	}
+	return i
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+func isBinary(c byte) bool {
+	return c == '0' || c == '1'
+}
+
+//	[-+]?(0[xX](_?[0-9a-fA-F])+|(0[oO](_?[0-7])+|0[bB](_?[01])+|\d(_?\d)*)[kKmMgGtT]?)
+//
+//	Note that "_?" means that an underscore may also come right
+//	after the prefix (0x_1f), as in Go. A hex number has no k/m/g/t
+//	suffix, like a hex size has no unit (see ByteSize).
+func scanInt(b []byte) int {
+	i := numSign(b)
+	if i + 2 < len(b) && b[i] == '0' {
+		var f func(c byte) bool
+		switch b[i + 1] {
+			case 'x', 'X':
+				f = isHex
+			case 'o', 'O':
+				f = isOctal
+			case 'b', 'B':
+				f = isBinary
+		}
+		if f != nil {
+			n := digits(b, i + 2, f)
+			if n == 0 && b[i + 2] == '_' {
+				n = digits(b, i + 3, f)
+				if n > 0 {
+					n++
+				}
+			}
+			if n > 0 && b[i + 1] != 'x' && b[i + 1] != 'X' {
+				return numSuffix(b, i + 2 + n)
+			}
+			if n > 0 {
+				return i + 2 + n
+			}
+		}
+	}
+	n := digits(b, i, isDigit)
+	if n == 0 {
+		return 0
+	}
+	return numSuffix(b, i + n)
+}
+
+//	[-+]?\d(_?\d)*(\.\d(_?\d)*)?([eE][-+]?\d(_?\d)*)?[kKmMgGtT]?
+func scanFloat(b []byte) int {
+	i := numSign(b)
+	n := digits(b, i, isDigit)
+	if n == 0 {
+		return 0
+	}
+	i += n
+	if i < len(b) && b[i] == '.' {
+		if n = digits(b, i + 1, isDigit); n > 0 {
+			i += 1 + n
+		}
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		j := i + 1
+		if j < len(b) && (b[j] == '-' || b[j] == '+') {
+			j++
+		}
+		if n = digits(b, j, isDigit); n > 0 {
+			i = j + n
+		}
+	}
+	return numSuffix(b, i)
+}
+
+//	\d(_?\d)*(\.\d(_?\d)*)?([eE][-+]?\d(_?\d)*)?([kKmMgGtTpPeE]i?)?[bB]
+//
+//	A size like 64KiB or 1.5GB. "1EB" is 1 exabyte, not 1 with a
+//	bad exponent.
+func scanSize(b []byte) int {
+	unit := func(i int) int {
+		if i < len(b) && strings.IndexByte("kKmMgGtTpPeE", b[i]) >= 0 &&
+		   i + 1 < len(b) {
+			j := i + 1
+			if b[j] == 'i' {
+				j++
+			}
+			if j < len(b) && (b[j] == 'b' || b[j] == 'B') {
+				return j + 1
+			}
+		}
+		if i < len(b) && (b[i] == 'b' || b[i] == 'B') {
+			return i + 1
+		}
+		return 0
+	}
+	n := digits(b, 0, isDigit)
+	if n == 0 {
+		return 0
+	}
+	i := n
+	if i < len(b) && b[i] == '.' {
+		if n = digits(b, i + 1, isDigit); n > 0 {
+			i += 1 + n
+		}
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		j := i + 1
+		if j < len(b) && (b[j] == '-' || b[j] == '+') {
+			j++
+		}
+		if n = digits(b, j, isDigit); n > 0 {
+			if u := unit(j + n); u > 0 {
+				return u
+			}
+		}
+	}
+	return unit(i)
+}
+
+//	"(?:(?:\\"|[^"])+(:?"|$)|")
+//
+//	\" does not end the string, and an unterminated string runs to
+//	the end of the input. "" is the empty string.
+func scanDQString(b []byte) int {
+	if len(b) == 0 || b[0] != '"' {
+		return 0
+	}
+	i := 1
+	for i < len(b) {
+		if b[i] == '\\' && i + 1 < len(b) && b[i + 1] == '"' {
+			i += 2
+		} else if b[i] != '"' {
+			i++
+		} else {
+			break
+		}
+	}
+	if i == len(b) {
+		if i == 1 {
+			return 0
+		}
+		return i
+	}
+	return i + 1
+}
+
+//	[a-zA-Z][a-zA-Z0-9-]*[a-zA-Z0-9]*
+func scanIdent(b []byte) int {
+	if len(b) == 0 || !isLetter(b[0]) {
+		return 0
+	}
+	return 1 + run(b, 1, func(c byte) bool {
+		return isLetter(c) || isDigit(c) || c == '-'
+	})
+}
+
+//	\.{0,2}/[0-9a-zA-Z./_-]+
+func scanFilename(b []byte) int {
+	i := run(b, 0, func(c byte) bool { return c == '.' })
+	if i > 2 || i >= len(b) || b[i] != '/' {
+		return 0
+	}
+	n := run(b, i + 1, func(c byte) bool {
+		return isLetter(c) || isDigit(c) ||
+			c == '.' || c == '/' || c == '_' || c == '-'
+	})
+	if n == 0 {
+		return 0
+	}
+	return i + 1 + n
+}
+
+//
+//	Length of a hostname letter or digit at b[i], or 0. The hostname
+//	expression is case-insensitive, and in Go that means that [k] also
+//	matches the Kelvin sign (U+212A) and [s] the long s (U+017F).
+//
+func hostChar(b []byte, i int) int {
+	if i >= len(b) {
+		return 0
+	}
+	switch c := b[i]; {
+		case isLetter(c) || isDigit(c):
+			return 1
+		case c == 0xe2 && i + 2 < len(b) && b[i+1] == 0x84 && b[i+2] == 0xaa:
+			return 3
+		case c == 0xc5 && i + 1 < len(b) && b[i+1] == 0xbf:
+			return 2
+	}
+	return 0
+}
+
+//
+//	A hostname label: letters, digits and dashes from b[i], starting
+//	with a letter or digit. Returns the end of the label and the end
+//	of its last letter or digit (so the label ends with a dash if
+//	those are different). end is i if there is no label.
+//
+func hostLabel(b []byte, i int) (end, alnum int) {
+	if hostChar(b, i) == 0 {
+		return i, i
+	}
+	end = i
+	for {
+		if w := hostChar(b, end); w > 0 {
+			end += w
+			alnum = end
+		} else if end < len(b) && b[end] == '-' {
+			end++
+		} else {
+			return
+		}
+	}
+}
+
+//	(?i:([0-9a-z][0-9a-z-]*[0-9a-z]|[0-9a-z]+)(\.([0-9a-z][0-9a-z-]*[0-9a-z]|[0-9a-z]+)+))
+//
+//	That is a label, a dot, and one or more labels without dots
+//	between them: so only a single dot. This returns the end of the
+//	first label, and the end of the second part and of its last letter
+//	or digit. ok is false if there is no hostname.
+func hostname(b []byte) (end, alnum int, ok bool) {
+	e, a := hostLabel(b, 0)
+	if e == 0 || e != a || e >= len(b) || b[e] != '.' {
+		return
+	}
+	end, alnum = hostLabel(b, e + 1)
+	ok = end > e + 1
+	return
+}
+
+func scanHostname(b []byte) int {
+	_, alnum, ok := hostname(b)
+	if !ok {
+		return 0
+	}
+	return alnum
+}
+
+//	(hostname:\d+)
+func scanHostPort(b []byte) int {
+	end, alnum, ok := hostname(b)
+	if !ok || end != alnum || end >= len(b) || b[end] != ':' {
+		return 0
+	}
+	n := run(b, end + 1, isDigit)
+	if n == 0 {
+		return 0
+	}
+	return end + 1 + n
+}
+
+//
+//	(([0-9]{1,3}\.){3}[0-9]{1,3}) - returns the end of the first
+//	three octets, and the number of digits of the last one
+//	(which can be more than 3).
+//
+func ipv4(b []byte) (i, last int, ok bool) {
+	for o := 0; o < 3; o++ {
+		n := run(b, i, isDigit)
+		if n == 0 || n > 3 || i + n >= len(b) || b[i + n] != '.' {
+			return
+		}
+		i += n + 1
+	}
+	last = run(b, i, isDigit)
+	ok = last > 0
+	return
+}
+
+//	(([0-9]{1,3}\.){3}[0-9]{1,3})(/[0-9]+)?
+func scanIPv4(b []byte) int {
+	i, last, ok := ipv4(b)
+	if !ok {
+		return 0
+	}
+	if last > 3 {
+		// the expression takes the first three digits.
+		return i + 3
+	}
+	i += last
+	if i < len(b) && b[i] == '/' {
+		if n := run(b, i + 1, isDigit); n > 0 {
+			i += 1 + n
+		}
+	}
+	return i
+}
+
+//	((\*|ipv4):\d+)
+func scanIPv4Port(b []byte) (i int) {
+	if len(b) > 0 && b[0] == '*' {
+		i = 1
+	} else {
+		var last int
+		var ok bool
+		if i, last, ok = ipv4(b); !ok || last > 3 {
+			return 0
+		}
+		i += last
+		if i < len(b) && b[i] == '/' {
+			n := run(b, i + 1, isDigit)
+			if n == 0 {
+				return 0
+			}
+			i += 1 + n
+		}
+	}
+	if i >= len(b) || b[i] != ':' {
+		return 0
+	}
+	n := run(b, i + 1, isDigit)
+	if n == 0 {
+		return 0
+	}
+	return i + 1 + n
+}
+
+//
+//	The IPv6 expression has alternatives and repetitions that can
+//	match in more than one way; in "[ipv6]:port" it matters which
+//	one is chosen. So this is a small backtracking matcher: it tries
+//	the ways to match in the order the regexp package would, and
+//	calls k with the end of each match until k returns true.
+//
+
+//	[0-9a-f]{1,4}
+func ipv6Hex(b []byte, i int, k func(int) bool) bool {
+	n := 0
+	for n < 4 && i + n < len(b) && isHex(b[i + n]) {
+		n++
+	}
+	for ; n > 0; n-- {
+		if k(i + n) {
+			return true
+		}
+	}
+	return false
+}
+
+//	(H:){min,max} or (:H){min,max}
+func ipv6Rep(b []byte, i, n, min, max int, colonFirst bool, k func(int) bool) bool {
+	if n < max {
+		next := func(j int) bool {
+			return ipv6Rep(b, j, n + 1, min, max, colonFirst, k)
+		}
+		if colonFirst {
+			if i < len(b) && b[i] == ':' &&
+			   ipv6Hex(b, i + 1, next) {
+				return true
+			}
+		} else {
+			if ipv6Hex(b, i, func(j int) bool {
+				return j < len(b) && b[j] == ':' && next(j + 1)
+			}) {
+				return true
+			}
+		}
+	}
+	return n >= min && k(i)
+}
+
+//	(?i:(((([0-9a-f]{1,4}:){1,7}|:)((:[0-9a-f]{1,4}){1,7}|:))|([0-9a-f]{1,4}:){7}[0-9a-f]{1,4}))(/[0-9]+)?
+func ipv6(b []byte, i int, k func(int) bool) bool {
+
+	// A quick check: it starts with a colon, or 1-4 hex digits
+	// and a colon.
+	n := run(b, i, isHex)
+	if !(i < len(b) && b[i] == ':') &&
+	   !(n > 0 && n <= 4 && i + n < len(b) && b[i + n] == ':') {
+		return false
+	}
+
+	// (/[0-9]+)?
+	prefix := func(e int) bool {
+		if e < len(b) && b[e] == '/' {
+			for d := run(b, e + 1, isDigit); d > 0; d-- {
+				if k(e + 1 + d) {
+					return true
+				}
+			}
+		}
+		return k(e)
+	}
+	// ((:H){1,7}|:)
+	second := func(j int) bool {
+		if ipv6Rep(b, j, 0, 1, 7, true, prefix) {
+			return true
+		}
+		return j < len(b) && b[j] == ':' && prefix(j + 1)
+	}
+	// ((H:){1,7}|:)
+	if ipv6Rep(b, i, 0, 1, 7, false, second) {
+		return true
+	}
+	if b[i] == ':' && second(i + 1) {
+		return true
+	}
+	// (H:){7}H
+	return ipv6Rep(b, i, 0, 7, 7, false, func(j int) bool {
+		return ipv6Hex(b, j, prefix)
+	})
+}
+
+func scanIPv6(b []byte) (n int) {
+	ipv6(b, 0, func(e int) bool {
+		n = e
+		return true
+	})
+	return
+}
+
+//	(\[ipv6\]:\d+)
+func scanIPv6Port(b []byte) (n int) {
+	if len(b) == 0 || b[0] != '[' {
+		return 0
+	}
+	ipv6(b, 1, func(e int) bool {
+		if e + 1 >= len(b) || b[e] != ']' || b[e + 1] != ':' {
+			return false
+		}
+		d := run(b, e + 2, isDigit)
+		if d == 0 {
+			return false
+		}
+		n = e + 2 + d
+		return true
+	})
+	return
+}
+
+//	[@!]?[0-9a-z+_*]+(\.[0-9a-z+_*]+)*
+func scanNgMatch(b []byte) int {
+	ng := func(c byte) bool {
+		return (c >= 'a' && c <= 'z') || isDigit(c) ||
+			c == '+' || c == '_' || c == '*'
+	}
+	i := 0
+	if len(b) > 0 && (b[0] == '@' || b[0] == '!') {
+		i = 1
+	}
+	n := run(b, i, ng)
+	if n == 0 {
+		return 0
+	}
+	i += n
+	for i < len(b) && b[i] == '.' {
+		n = run(b, i + 1, ng)
+		if n == 0 {
+			break
+		}
+		i += 1 + n
+	}
+	return i
+}
+
+//	(//|#)[^\n]*
+func scanComment(b []byte) int {
+	i := 0
+	switch {
+		case len(b) > 0 && b[0] == '#':
+			i = 1
+		case len(b) > 1 && b[0] == '/' && b[1] == '/':
+			i = 2
+		default:
+			return 0
+	}
+	return i + run(b, i, func(c byte) bool { return c != '\n' })
+}
+
+// Bytes that end a value with variables in it.
+const varStop = "\t\n\f\r ;,{}()\"'#=$"
+
+// Bytes that a value with variables can start with: all but varStop,
+// and the $ of ${ or $${.
+var chVar = func() string {
+	var b []byte
+	for c := 0; c < 256; c++ {
+		if c == '$' || strings.IndexByte(varStop, byte(c)) < 0 {
+			b = append(b, byte(c))
+		}
+	}
+	return string(b)
+}()
+
+//	\$\{[^}\n]*\}
+func varRef(b []byte, i int) int {
+	if i + 1 >= len(b) || b[i] != '$' || b[i+1] != '{' {
+		return 0
+	}
+	for j := i + 2; j < len(b) && b[j] != '\n'; j++ {
+		if b[j] == '}' {
+			return j + 1 - i
+		}
+	}
+	return 0
+}
+
+//	(V|R)*R(V|R)* where V is a byte that is not in varStop, and
+//	R is varRef or $varRef (a literal ${).
+func scanVar(b []byte) int {
+	i, refs := 0, 0
+	for i < len(b) {
+		if n := varRef(b, i); n > 0 {
+			i += n
+			refs++
+		} else if n := varRef(b, i + 1); n > 0 && b[i] == '$' {
+			i += 1 + n
+			refs++
+		} else if strings.IndexByte(varStop, b[i]) < 0 {
+			i++
+		} else {
+			break
+		}
+	}
+	if refs == 0 {
+		return 0
+	}
+	return i
+}
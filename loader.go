@@ -0,0 +1,214 @@
+//
+//	Loader: read several files ("layers") into the same struct,
+//	for example /usr/share/app/defaults.conf, /etc/app.conf and
+//	/etc/app.d/$HOST.conf.
+//
+//	The layers are read in order, as if they were one file, except
+//	for fields that were already set by an earlier layer. How those
+//	are merged depends on the merge option of the cc tag:
+//
+//	replace		the values of the earlier layers are dropped.
+//			This is the default for slices of values.
+//	append		the values are added to those of the earlier layers.
+//	name		sections with the same name (Name_) are merged,
+//			others are added. This is the default for slices
+//			of sections and for maps (by key).
+//
+//	With append, a section in a later layer is a new section, also if
+//	an earlier layer has one with the same name. Within a layer the
+//	parts of a section are merged as usual. The path of such a second
+//	section is by index, "person[1]", as for sections without a name.
+//
+//	A single value is always replaced, and a single section merged,
+//	unless it has merge=replace. Defaults, required fields and
+//	Validate are handled after the last layer.
+//
+
+package curlyconf
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	mergeReplace	= "replace"
+	mergeAppend	= "append"
+	mergeName	= "name"
+)
+
+// A Loader reads a configuration from several files.
+type Loader struct {
+	parserType	int
+	layers		[]loaderLayer
+	setup		func(p *Parser)
+	files		[]string
+	origin		map[string]int
+	sources		Sources
+}
+
+type loaderLayer struct {
+	file		string
+	optional	bool
+}
+
+// Returns a Loader for files of type parserType. Add the files with
+// Add and AddOptional.
+func NewLoader(parserType int) *Loader {
+	return &Loader{ parserType: parserType }
+}
+
+// Add a file. It is an error if it does not exist.
+func (l *Loader) Add(file string) {
+	l.layers = append(l.layers, loaderLayer{ file: file })
+}
+
+// Add a file that is skipped if it does not exist.
+func (l *Loader) AddOptional(file string) {
+	l.layers = append(l.layers, loaderLayer{ file: file, optional: true })
+}
+
+// Setup sets a function that is called for the Parser before it reads
+// the files, for example to set options or overrides.
+func (l *Loader) Setup(fn func(p *Parser)) {
+	l.setup = fn
+}
+
+// Load reads the files into obj, which must be a pointer to a struct.
+// Errors in any of the files are returned as one *ParseError.
+func (l *Loader) Load(obj interface{}) (err error) {
+	l.files = nil
+	var p *Parser
+	for _, ly := range l.layers {
+		if ly.optional {
+			if _, err := os.Stat(ly.file); errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+		}
+		if p == nil {
+			if p, err = NewParser(ly.file, l.parserType); err != nil {
+				return
+			}
+		} else {
+			t, e := confTokenizer(ly.file)
+			if e != nil {
+				pe := &ParseError{}
+				pe.add(newDiagnostic(nil, CodeIO, e.Error(), e))
+				return pe
+			}
+			p.layers = append(p.layers, t)
+		}
+		l.files = append(l.files, ly.file)
+	}
+	if p == nil {
+		p, _ = NewParserFromString("", l.parserType)
+	}
+	if l.setup != nil {
+		l.setup(p)
+	}
+	err = p.Parse(obj)
+	l.origin = p.fieldLayer
+	l.sources = p.sources
+	return
+}
+
+// Files returns the layers that were read by the last Load, without
+// the optional files that did not exist.
+func (l *Loader) Files() []string {
+	return l.files
+}
+
+// Origin returns the layer that supplied the value of a field, by
+// path ("person[snoopy].address"), after Load. ok is false if the
+// field was not set by any of the files.
+func (l *Loader) Origin(path string) (file string, ok bool) {
+	n, ok := l.origin[path]
+	if ok && n < len(l.files) {
+		file = l.files[n]
+	}
+	return
+}
+
+// Sources returns where the value of each field came from after Load,
+// if the Setup function called SetRecordSources.
+func (l *Loader) Sources() Sources {
+	return l.sources
+}
+
+//
+//	How field f is merged.
+//
+func (f *structField) mergeMode() string {
+	if f.tag.merge != "" {
+		return f.tag.merge
+	}
+	switch {
+		case f.isMap(), f.fieldType.Kind() == reflect.Slice && f.IsStruct():
+			if f.HasName() {
+				return mergeName
+			}
+			return mergeAppend
+		case f.IsSlice():
+			return mergeReplace
+	}
+	return ""
+}
+
+//
+//	A field is set by layer p.layer. If an earlier layer set it and
+//	it is to be replaced, start again. A slice of sections that is
+//	appended to gets new sections, even with the same names as
+//	those of earlier layers.
+//
+func (p *Parser) mergeField(f *structField) {
+	if p.fieldLayer == nil {
+		p.fieldLayer = map[string]int{}
+		p.appendFrom = map[string]int{}
+	}
+	if f.fieldType.Kind() == reflect.Slice && f.mergeMode() == mergeAppend {
+		if n, ok := p.fieldLayer[f.path]; ok && n < p.layer {
+			p.appendFrom[f.path] = f.val.Len()
+		}
+		f.from = p.appendFrom[f.path]
+	}
+	if n, ok := p.fieldLayer[f.path]; ok && n < p.layer && f.mergeMode() == mergeReplace {
+		f.val.Set(reflect.Zero(f.fieldType))
+		f.store()
+		p.sources.drop(f.path)
+		for path := range p.fieldLayer {
+			if inPath(path, f.path) {
+				delete(p.fieldLayer, path)
+			}
+		}
+		// forget what the sections that were dropped had seen.
+		for path := range p.sections {
+			if path == f.path || inPath(path, f.path) {
+				delete(p.sections, path)
+			}
+		}
+	}
+	p.fieldLayer[f.path] = p.layer
+}
+
+//
+//	Is path below (not at) prefix?
+//
+func inPath(path, prefix string) bool {
+	return strings.HasPrefix(path, prefix + ".") ||
+	       strings.HasPrefix(path, prefix + "[")
+}
+
+//
+//	Start reading the next layer.
+//
+func (p *Parser) nextLayer() {
+	t := p.layers[0]
+	p.layers = p.layers[1:]
+	t.SetSpace(p.space)
+	p.tok = t
+	p.files = append(p.files, t.file)
+	p.layer++
+}
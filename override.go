@@ -0,0 +1,368 @@
+//
+//	Overrides: set fields from the command line or the environment,
+//	after the file has been parsed.
+//
+//	-o person.charlie.address=10.0.0.1
+//	APP_PERSON_CHARLIE_ADDRESS=10.0.0.1
+//
+//	A path is resolved like the statements in the file: field
+//	names and cc aliases, then the name of the section if it has
+//	one. "person[charlie].address" is the same path.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// An override of a field.
+type override struct {
+	source	string		// for messages: "person.x=y" or the variable
+	comps	[]string
+	env	bool		// from the environment: split at "_"
+	value	string
+}
+
+// Override sets the field at path to value after the file has been
+// parsed, before defaults are filled in and sections are validated.
+// The path is like "person.charlie.address" or "person[charlie].address".
+// A section that is not in the file is created. For a slice, the value
+// is a comma separated list that replaces the values from the file.
+//
+// A -o flag can be passed on like this:
+//
+//	path, value, _ := strings.Cut(arg, "=")
+//	p.Override(path, value)
+//
+// Errors, such as a path that does not exist, are returned by Parse.
+func (p *Parser) Override(path, value string) {
+	p.overrides = append(p.overrides, &override{
+		source: path + "=" + value,
+		comps: splitPath(path),
+		value: value,
+	})
+}
+
+// OverrideEnv adds an override for each environment variable that
+// starts with prefix, for example "APP_". The rest of the name is the
+// path in upper case, with "_" between the names: APP_PERSON_CHARLIE_ADDRESS
+// is person.charlie.address. A field name with a "-" (max-conn) is
+// written with a "_" (APP_MAX_CONN).
+//
+// Section names are matched with the sections in the file ignoring
+// case, so the variable above also sets person[Charlie].address; a
+// name with a "-" or "_" is written with a "_". Two sections whose
+// names differ only in case cannot be told apart, which is an error.
+// A section that is not in the file is created with a lower case name.
+func (p *Parser) OverrideEnv(prefix string) {
+	env := os.Environ()
+	sort.Strings(env)
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+			continue
+		}
+		p.overrides = append(p.overrides, &override{
+			source: name,
+			comps: strings.Split(strings.ToLower(name[len(prefix):]), "_"),
+			env: true,
+			value: value,
+		})
+	}
+}
+
+//
+//	"person[charlie].address" and "person.charlie.address" are
+//	both person, charlie, address.
+//
+func splitPath(path string) (comps []string) {
+	for path != "" {
+		switch path[0] {
+			case '.':
+				path = path[1:]
+			case '[':
+				i := strings.IndexByte(path, ']')
+				if i < 0 {
+					i = len(path)
+					path += "]"
+				}
+				comps = append(comps, path[1:i])
+				path = path[i+1:]
+			default:
+				i := strings.IndexAny(path, ".[")
+				if i < 0 {
+					i = len(path)
+				}
+				comps = append(comps, path[:i])
+				path = path[i:]
+		}
+	}
+	return
+}
+
+//
+//	Apply the overrides.
+//
+func (p *Parser) applyOverrides(sw *structWriter) {
+	for _, o := range p.overrides {
+		if len(o.comps) == 0 {
+			p.overrideError(o, "empty path")
+			continue
+		}
+		p.override(sw, o, o.comps)
+	}
+}
+
+//
+//	Report a bad override.
+//
+func (p *Parser) overrideError(o *override, format string, a ...interface{}) {
+	p.report(nil, CodeOverride, "override " + o.source + ": " +
+		fmt.Sprintf(format, a...), nil)
+}
+
+//
+//	Apply an override to the rest of the path in comps.
+//
+func (p *Parser) override(sw *structWriter, o *override, comps []string) {
+	field, n := p.overrideField(sw, o, comps)
+	if field == nil {
+		return
+	}
+	comps = comps[n:]
+	p.markSeen(sw, field, nil)
+	src := Source{ Origin: OriginOverride, Override: o.source }
+
+	if field.IsStruct() {
+		var name string
+		if field.HasName() {
+			if len(comps) == 0 {
+				p.overrideError(o, "%s: section name expected", field.path)
+				return
+			}
+			n := 1
+			name = comps[0]
+			if o.env {
+				var err error
+				if name, n, err = envSectionName(field, comps); err != nil {
+					p.overrideError(o, "%s: %s", field.path, err)
+					return
+				}
+			}
+			comps = comps[n:]
+		}
+		if len(comps) == 0 {
+			path := field.path
+			if name != "" {
+				path += "[" + name + "]"
+			}
+			p.overrideError(o, "%s is a section", path)
+			return
+		}
+		if err := field.Section(name); err != nil {
+			p.overrideError(o, "%s: %s", field.path, err)
+			return
+		}
+		p.state(field.elemPath, nil)
+		p.record(field.elemPath, src, true)
+		p.override(field.writer(), o, comps)
+		field.Done()
+		return
+	}
+	if len(comps) > 0 {
+		p.overrideError(o, "%s is not a section", field.path)
+		return
+	}
+
+	p.record(field.path, src, false)
+	values := []string{ o.value }
+	if field.IsSlice() {
+		values = splitList(o.value)
+		field.val.Set(reflect.Zero(field.fieldType))
+	}
+	for _, v := range values {
+		err := field.Set(v)
+		if err == nil {
+			err = field.tag.check(field.elem)
+		}
+		if err != nil {
+			p.overrideError(o, "%s: %s", field.path, err)
+		}
+	}
+}
+
+//
+//	Find the field for the start of comps. Returns the field and
+//	the number of names it used, or nil after reporting an error.
+//
+func (p *Parser) overrideField(sw *structWriter, o *override, comps []string) (f *structField, n int) {
+	if sw.stru.Kind() == reflect.Map {
+		// a map of values: the key is the rest of the path.
+		n = 1
+		if o.env {
+			n = len(comps)
+		}
+		f, err := sw.structField(strings.Join(comps[:n], "_"))
+		if err != nil {
+			p.overrideError(o, "%s", err)
+			return nil, 0
+		}
+		return f, n
+	}
+	if !o.env {
+		f, err := sw.structField(comps[0])
+		if err != nil {
+			p.overrideError(o, "%s%s", err, suggest(comps[0], fieldNames(sw.stru.Type())))
+			return nil, 0
+		}
+		return f, 1
+	}
+
+	// The longest field name wins: APP_MAX_CONN is max-conn or
+	// maxconn before it is max.
+	for n = len(comps); n > 0; n-- {
+		for _, sep := range []string{ "-", "", "_" } {
+			if f, err := sw.structField(strings.Join(comps[:n], sep)); err == nil {
+				return f, n
+			}
+		}
+	}
+	p.overrideError(o, "unknown field %s%s", comps[0],
+		suggest(comps[0], fieldNames(sw.stru.Type())))
+	return nil, 0
+}
+
+//
+//	The name of a section in an environment variable, which is in
+//	lower case and split at "_". It is matched with the sections
+//	that exist, ignoring case, and can be more than one word:
+//	APP_PERSON_WEB_1_ADDRESS is person[Web-1].address. If there is
+//	no such section it is new, and its name is the first word.
+//
+func envSectionName(f *structField, comps []string) (name string, n int, err error) {
+	names := f.sectionNames()
+	for n = len(comps); n > 0; n-- {
+		for _, sep := range []string{ "-", "_", "" } {
+			s := strings.Join(comps[:n], sep)
+			var found []string
+			for _, name := range names {
+				if strings.EqualFold(name, s) {
+					found = append(found, name)
+				}
+			}
+			switch len(found) {
+				case 0:
+					continue
+				case 1:
+					return found[0], n, nil
+			}
+			return "", 0, fmt.Errorf("section name %s is ambiguous: %s",
+				s, strings.Join(found, ", "))
+		}
+	}
+	return comps[0], 1, nil
+}
+
+//
+//	The names of the sections that field f has now.
+//
+func (f *structField) sectionNames() (names []string) {
+	v := reflect.Indirect(f.val)
+	switch v.Kind() {
+		case reflect.Map:
+			for _, k := range v.MapKeys() {
+				names = append(names, fmt.Sprint(k.Interface()))
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				e := reflect.Indirect(v.Index(i))
+				if e.Kind() == reflect.Struct {
+					names = append(names, e.FieldByName("Name_").String())
+				}
+			}
+		case reflect.Struct:
+			names = append(names, v.FieldByName("Name_").String())
+	}
+	return
+}
+
+//
+//	Split a list of values at the commas, as in the file.
+//	If that does not work it is one value.
+//
+func splitList(s string) (r []string) {
+	t, _ := confTokenizerFromString(s)
+	for {
+		tok := t.Next()
+		if (tok.Token & tokValue) == 0 {
+			return []string{ s }
+		}
+		r = append(r, string(tok.Value))
+		tok = t.Next()
+		if tok.Token == tokEOF {
+			return
+		}
+		if (tok.Token & tokComma) == 0 {
+			return []string{ s }
+		}
+	}
+}
+
+//
+//	Names and aliases of the fields of a struct.
+//
+func fieldNames(tp reflect.Type) (names []string) {
+	for i := 0; i < tp.NumField(); i++ {
+		sf := tp.Field(i)
+		if sf.Name[:1] != strings.ToUpper(sf.Name[:1]) || sf.Name == "Name_" {
+			continue
+		}
+		names = append(names, strings.ToLower(sf.Name))
+		names = append(names, parseTag(sf).names...)
+	}
+	return
+}
+
+//
+//	" (did you mean x?)" if one of the names is close to name.
+//
+func suggest(name string, names []string) string {
+	best, bestDist := "", len(name) / 3 + 1
+	for _, n := range names {
+		if d := levenshtein(name, n); d > 0 && d < bestDist {
+			best, bestDist = n, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return " (did you mean " + best + "?)"
+}
+
+//
+//	Edit distance between two strings.
+//
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b) + 1)
+	cur := make([]int, len(b) + 1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j] + 1, cur[j-1] + 1, prev[j-1] + cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
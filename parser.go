@@ -2,38 +2,78 @@ package curlyconf
 
 import (
         "fmt"
+        "io"
+        "io/fs"
         "strconv"
+        "strings"
 )
 
-// This is returned on error. Detail contains a few lines that
-// print the lines that have errors, and pinpoint the location.
+// This is returned on error. Diagnostics has the errors, with their
+// position in the file. Detail contains the same errors as a few
+// lines that print the lines that have errors, and pinpoint the location.
 type ParseError struct {
-	Detail	[]string		// detailed error (line/position)
+	Detail		[]string		// detailed error (line/position)
+	Diagnostics	[]*Diagnostic
 }
 
 // Returns a short (one-line) error, useful for logs.
 func (pe *ParseError) Error() string {
-	if pe == nil || len(pe.Detail) == 0 {
+	if pe == nil || len(pe.Diagnostics) == 0 {
 		return "curlyconf: unknown empty error";
 	}
-	return pe.Detail[0]
+	return pe.Diagnostics[0].Error()
 }
 
 // Returns a multiline error (for printing on tty)
 func (pe *ParseError) LongError() string {
-	msg := ""
-	for i, e := range pe.Detail {
-		msg = msg + e
-		if i < len(pe.Detail) - 1 {
-			msg += "\n"
+	var msg []string
+	for _, d := range pe.Diagnostics {
+		msg = append(msg, d.LongError())
+	}
+	return strings.Join(msg, "\n")
+}
+
+// Returns the errors that caused the diagnostics, for errors.Is
+// and errors.As. These are for example the errors returned by
+// UnmarshalText.
+func (pe *ParseError) Unwrap() (r []error) {
+	for _, d := range pe.Diagnostics {
+		if d.Err != nil {
+			r = append(r, d.Err)
 		}
 	}
-	return msg
+	return
 }
 
+func (pe *ParseError) add(d *Diagnostic) {
+	pe.Diagnostics = append(pe.Diagnostics, d)
+	pe.Detail = append(pe.Detail, d.detail...)
+}
 
+// A Parser reads one configuration, and is not safe for concurrent
+// use: use a Parser from one goroutine at a time. Different Parsers
+// share no mutable state, so any number of them can be created and
+// used at the same time on different goroutines. The objects that
+// are filled by Parse should of course not be shared either.
 type Parser struct {
 	tok		*tokenizer
+	tokStack	[]*tokenizer	// files that are including p.tok
+	depth		int		// depth of nested blocks
+	between		bool		// between two statements
+	space		string
+	maxInclude	int
+	files		[]string
+	fsys		fs.FS		// for NewParserFS
+	conv		convContext
+	expandVars	bool		// set and ${name}, see SetExpandVars
+	scope		*varScope	// variables of the current section
+	envAllow	[]string	// environment variables that may be read
+	overrides	[]*override
+	layers		[]*tokenizer	// files still to read, for Loader
+	layer		int		// layer that is being read
+	fieldLayer	map[string]int	// layer that set each field, by path
+	appendFrom	map[string]int	// merge=append: first element of this layer
+	sources		Sources		// if SetRecordSources
 	stmtEnd		uint64		// \n or ;
 	sectionStart	uint64		// { or '\n'
 	sectionEnd	uint64		// } or 'end'
@@ -41,6 +81,8 @@ type Parser struct {
 	sectionStartStr	string
 	sectionEndStr	string
 	sectionName	string
+	parserType	int
+	sections	map[string]*sectionState
 	errors		ParseError
 	errCount	int
 	maxErrors	int
@@ -69,27 +111,61 @@ func debug(format string, a ...interface{}) {
 //	Add an error to the list of errors.
 //
 func (p *Parser) error(t *tokInfo, s string) {
+	p.report(t, CodeSyntax, s, nil)
+}
+
+//
+//	Add an error that was returned by something else.
+//
+func (p *Parser) errorErr(t *tokInfo, code string, err error) {
+	p.report(t, code, err.Error(), err)
+}
+
+func (p *Parser) report(t *tokInfo, code string, s string, err error) {
 	if p.sectionName != "" {
 		s = "section " + p.sectionName + ": " + s
 	}
-	if t == nil {
-		p.errors.Detail = append(p.errors.Detail, s)
-		debug("%s", s)
-	} else {
-		e := t.Error(s)
-		p.errors.Detail = append(p.errors.Detail, e...)
-		for _, m := range e {
-			debug("%s", m)
-		}
+	d := newDiagnostic(t, code, s, err)
+	p.errors.add(d)
+	for _, m := range d.detail {
+		debug("%s", m)
 	}
 	p.errCount++
 }
 
+//
+//	Look at the next token. If an included file is exhausted,
+//	continue with the file that included it. That is only possible
+//	between statements, in the block of the include statement;
+//	otherwise the end-of-file is returned, which is an error.
+//
+func (p *Parser) peekToken() (tok *tokInfo) {
+	for {
+		tok = p.tok.Peek()
+		if tok.Token != tokEOF || len(p.tokStack) == 0 {
+			return
+		}
+		if !p.between || p.tok.depth != p.depth {
+			return
+		}
+		p.tok = p.tokStack[len(p.tokStack) - 1]
+		p.tokStack = p.tokStack[:len(p.tokStack) - 1]
+	}
+}
+
+//
+//	Get the next token.
+//
+func (p *Parser) nextToken() (tok *tokInfo) {
+	p.peekToken()
+	return p.tok.Next()
+}
+
 //
 //	peek() looks for an optional token
 //
 func (p *Parser) peek(want uint64) (tok *tokInfo) {
-	next := p.tok.Peek()
+	next := p.peekToken()
 	if (next.Token & want) != 0 {
 		debug("peek: got %s\n", esc(next.Value))
 		tok = next
@@ -101,10 +177,10 @@ func (p *Parser) peek(want uint64) (tok *tokInfo) {
 //	accept() looks for an optional token
 //
 func (p *Parser) accept(want uint64) (tok *tokInfo) {
-	next := p.tok.Peek()
+	next := p.peekToken()
 	if (next.Token & want) != 0 {
 		debug("accept: got %s\n", esc(next.Value))
-		tok = p.tok.Next()
+		tok = p.nextToken()
 	}
 	return
 }
@@ -113,7 +189,7 @@ func (p *Parser) accept(want uint64) (tok *tokInfo) {
 //	expect() demands a certain token, otherwise error
 //
 func (p *Parser) expect(want uint64, ws string) (tok *tokInfo, match bool) {
-	tok = p.tok.Next()
+	tok = p.nextToken()
 	if tok.Token == tokEOF {
 		p.error(tok, "unexpected end-of-file")
 		p.errCount = 1000
@@ -133,7 +209,7 @@ func (p *Parser) expect(want uint64, ws string) (tok *tokInfo, match bool) {
 //
 func (p *Parser) recover(tok *tokInfo) {
 	if tok == nil {
-		tok = p.tok.Next()
+		tok = p.nextToken()
 	}
 	for {
 		if tok.Token == tokEOF {
@@ -143,7 +219,7 @@ func (p *Parser) recover(tok *tokInfo) {
 			return
 		}
 		if (tok.Token & p.sectionEnd) != 0 {
-			if p.stmtEnd != 0 {
+			if p.stmtEnd != 0 && tok.tkz == p.tok {
 				p.tok.SetPos(tok)
 			}
 			return
@@ -154,14 +230,14 @@ func (p *Parser) recover(tok *tokInfo) {
 			p.recover(nil)
 			p.stmtEnd = tmp
 		}
-		tok = p.tok.Next()
+		tok = p.nextToken()
 	}
 }
 
 //
 //	New section
 //
-func (p *Parser) section(sname string, field *structField) {
+func (p *Parser) section(stok *tokInfo, field *structField) {
 	var ok bool
 	var tok *tokInfo
 	var name string
@@ -175,7 +251,10 @@ func (p *Parser) section(sname string, field *structField) {
 			p.recover(tok)
 			return
 		}
-		name = string(tok.Value)
+		if name, ok = p.expand(tok, string(tok.Value)); !ok {
+			p.recover(tok)
+			return
+		}
 		if len(name) > 0 && name[0] == '"' {
 			s, err := strconv.Unquote(name)
 			if err == nil {
@@ -199,17 +278,19 @@ func (p *Parser) section(sname string, field *structField) {
 	}
 
 	oldname := p.sectionName
-	p.sectionName = sname
+	p.sectionName = string(stok.Value)
 
 	// New section starts here
 	err := field.Section(name)
 	if err != nil {
-		p.error(tok, err.Error())
+		p.errorErr(tok, CodeSection, err)
 		p.recover(tok)
 		return
 	}
 
-	sw := newStructWriter(field.PtrToElem())
+	p.state(field.elemPath, stok)
+	sw := field.writer()
+	p.pushScope()
 	if flatmode {
 		p.stmt(sw)
 		p.accept(p.stmtEnd)
@@ -221,6 +302,9 @@ func (p *Parser) section(sname string, field *structField) {
 			p.accept(p.stmtEnd)
 		}
 	}
+	p.validateSection(field, stok)
+	field.Done()
+	p.popScope()
 
 	p.sectionName = oldname
 	return
@@ -245,17 +329,30 @@ func (p *Parser) stmt(sw *structWriter) {
 		return
 	}
 
+	// include is a keyword, also if there is a field with that
+	// name, and so is set if variables are expanded.
+	if string(tok.Value) == "include" {
+		p.include(tok)
+		return
+	}
+	if string(tok.Value) == "set" && p.expandVars {
+		p.set(tok)
+		return
+	}
+
 	// See if we known this identifier
 	field, err := sw.structField(string(tok.Value))
 	if err != nil {
-		p.error(tok, err.Error())
+		p.errorErr(tok, CodeUnknownField, err)
 		p.recover(tok)
 		return
 	}
 
+	p.markSeen(sw, field, tok)
+
 	// It's a section
 	if field.IsStruct() {
-		p.section(string(tok.Value), field)
+		p.section(tok, field)
 		return
 	}
 
@@ -270,9 +367,8 @@ func (p *Parser) stmt(sw *structWriter) {
 		if !ok {
 			break
 		}
-		err := field.Set(string(tok.Value))
-		if err != nil {
-			p.error(tok, err.Error())
+		if s, ok := p.expand(tok, string(tok.Value)); ok {
+			p.setField(field, tok, s)
 		}
 		if !field.IsSlice() || p.accept(tokComma) == nil {
 			tok, ok = p.expect(p.stmtEnd, p.stmtEndStr)
@@ -292,26 +388,43 @@ func (p *Parser) stmt(sw *structWriter) {
 //	Parse a bunch of statements
 //
 func (p *Parser) stmts(sw *structWriter, end uint64) {
+	p.depth++
 	for {
 		debug("stmts\n")
-		if p.accept(end) != nil {
-			return
+		p.between = true
+		tok := p.accept(end)
+		p.between = false
+		if tok != nil {
+			break
 		}
 		p.stmt(sw)
 		if p.errCount > p.maxErrors {
 			break
 		}
 	}
+	p.depth--
 }
 
 //
 //	Start the actual parsing.
 //
 func (p *Parser) Parse(obj interface{}) (err error) {
-	p.stmts(newStructWriter(obj), tokEOF)
+	sw := newStructWriter(obj)
+	sw.conv = &p.conv
+	p.stmts(sw, tokEOF)
+	for len(p.layers) > 0 && p.errCount <= p.maxErrors {
+		p.nextLayer()
+		p.stmts(sw, tokEOF)
+	}
+	if p.errCount <= p.maxErrors {
+		p.applyOverrides(sw)
+	}
+	if p.errCount <= p.maxErrors {
+		p.finish(sw.stru, "")
+	}
 	if p.errCount > 0 {
 		if p.errCount > p.maxErrors && p.errCount != 1000 {
-			p.error(nil, "too many errors")
+			p.report(nil, CodeTooMany, "too many errors", nil)
 		}
 		err = &p.errors
 	}
@@ -319,22 +432,22 @@ func (p *Parser) Parse(obj interface{}) (err error) {
 }
 
 //
-//	Return a new Parser object.
+//	Return a new Parser object for tokenizer t (or the error e
+//	from opening it).
 //
-func newConfParser(src int, data string, how int) (p *Parser, err error) {
-	var t *tokenizer
-	var e error
-	if src == 0 {
-        	t, e = confTokenizer(data)
-	} else {
-        	t, e = confTokenizerFromString(data)
-	}
+func newConfParser(t *tokenizer, e error, how int) (p *Parser, err error) {
         if e != nil {
-		err = &ParseError{ Detail: []string{ e.Error() } }
+		pe := &ParseError{}
+		pe.add(newDiagnostic(nil, CodeIO, e.Error(), e))
+		err = pe
                 return
         }
 	p = &Parser{
 		tok: t,
+		fsys: t.fsys,
+		space: " \t\r\n",
+		maxInclude: 16,
+		parserType: how,
 		stmtEnd: tokSemi,
 		stmtEndStr: "';'",
 		sectionStart: tokLCBrace,
@@ -347,7 +460,7 @@ func newConfParser(src int, data string, how int) (p *Parser, err error) {
 		case ParserNL:
 			p.stmtEnd = tokNL
 			p.stmtEndStr = "newline"
-			t.SetSpace(" \t\r")
+			p.space = " \t\r"
 		case ParserDiablo:
 			p.sectionStart = tokNL
 			p.sectionStartStr = "newline"
@@ -355,10 +468,14 @@ func newConfParser(src int, data string, how int) (p *Parser, err error) {
 			p.sectionEndStr = "\"end\""
 			p.stmtEnd = tokNL
 			p.stmtEndStr = "newline"
-			t.SetSpace(" \t\r")
+			p.space = " \t\r"
 		case ParserSemi:
 		default:
 	}
+	t.SetSpace(p.space)
+	if t.abs != "" {
+		p.files = append(p.files, t.file)
+	}
 	return
 }
 
@@ -368,13 +485,32 @@ func newConfParser(src int, data string, how int) (p *Parser, err error) {
 // The error returned is actually of type ParseError. To get
 // at that, use err.(curlyconf.ParseError)
 func NewParser(file string, parserType int) (p *Parser, err error) {
-	p, err = newConfParser(0, file, parserType)
+	t, e := confTokenizer(file)
+	p, err = newConfParser(t, e, parserType)
 	return
 }
 
 // Like NewParser, but parses a string instead of a file.
 func NewParserFromString(data string, parserType int) (p *Parser, err error) {
-	p, err = newConfParser(1, data, parserType)
+	t, e := confTokenizerFromString(data)
+	p, err = newConfParser(t, e, parserType)
+	return
+}
+
+// Like NewParser, but reads the configuration from r. The name is
+// used in error messages, and included files are relative to its
+// directory (so "-" or "<stdin>" means the current directory).
+func NewParserFromReader(r io.Reader, name string, parserType int) (p *Parser, err error) {
+	t, e := confTokenizerFromReader(r, name)
+	p, err = newConfParser(t, e, parserType)
 	return
 }
 
+// Like NewParser, but reads the file from a filesystem, for example
+// an embed.FS or a fstest.MapFS. Included files are read from the
+// same filesystem; absolute include paths are relative to its root.
+func NewParserFS(fsys fs.FS, file string, parserType int) (p *Parser, err error) {
+	t, e := confTokenizerFS(fsys, file)
+	p, err = newConfParser(t, e, parserType)
+	return
+}
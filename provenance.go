@@ -0,0 +1,156 @@
+//
+//	Provenance: where the value of each field came from.
+//
+//	With SetRecordSources the parser remembers, by field path
+//	("person[snoopy].address"), the statement that set a field
+//	and the include statements that led to its file, or that the
+//	value is a default or an override. An Encoder with SetSources
+//	writes the effective configuration with that as comments:
+//
+//	person snoopy {		# main.conf:10.1
+//		address 5.6.7.8;	# conf.d/a.conf:3.2 (included from main.conf:2)
+//		port 80;		# default
+//	}
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Origin says what kind of source a value came from.
+type Origin int
+
+const (
+	OriginFile Origin = iota	// a statement in a file
+	OriginDefault			// the default from the cc tag
+	OriginOverride			// Override or OverrideEnv
+)
+
+func (o Origin) String() string {
+	switch o {
+		case OriginFile:
+			return "file"
+		case OriginDefault:
+			return "default"
+		case OriginOverride:
+			return "override"
+	}
+	return fmt.Sprintf("origin(%d)", int(o))
+}
+
+// A Source is where the value of a field came from. For a field that
+// was set more than once (a slice, or a section that is spread over
+// the file) it is the last statement.
+type Source struct {
+	Origin		Origin
+	Pos		Position	// the statement, for OriginFile
+	Included	[]Position	// include statements that led to Pos.File, innermost first
+	Override	string		// for OriginOverride: "path=value" or the variable
+}
+
+// Returns the source as "file:line.column (included from file:line)",
+// "default" or "override path=value".
+func (s Source) String() string {
+	switch s.Origin {
+		case OriginFile:
+			r := fmt.Sprintf("%s:%d.%d", s.Pos.File, s.Pos.Line, s.Pos.Column)
+			var incl []string
+			for _, pos := range s.Included {
+				incl = append(incl, fmt.Sprintf("%s:%d", pos.File, pos.Line))
+			}
+			if len(incl) > 0 {
+				r += " (included from " + strings.Join(incl, ", ") + ")"
+			}
+			return r
+		case OriginOverride:
+			return "override " + s.Override
+	}
+	return s.Origin.String()
+}
+
+// Sources maps field paths to the source of their value.
+type Sources map[string]Source
+
+// SetRecordSources makes Parse remember where the value of each field
+// came from, see Source and Sources. It is off by default.
+func (p *Parser) SetRecordSources(on bool) {
+	p.sources = nil
+	if on {
+		p.sources = Sources{}
+	}
+}
+
+// Source returns where the value of the field at path came from, after
+// Parse. ok is false if the field was not set, or if SetRecordSources
+// was not called.
+func (p *Parser) Source(path string) (s Source, ok bool) {
+	s, ok = p.sources[path]
+	return
+}
+
+// Sources returns the sources of all fields that were set, after
+// Parse, or nil if SetRecordSources was not called.
+func (p *Parser) Sources() Sources {
+	return p.sources
+}
+
+//
+//	Field (or section) at path was set by the statement at tok.
+//
+func (p *Parser) recordTok(path string, tok *tokInfo) {
+	if p.sources == nil || tok == nil {
+		return
+	}
+	s := Source{ Origin: OriginFile, Pos: tok.Position() }
+	for inc := tok.tkz.incl; inc != nil; inc = inc.tkz.incl {
+		s.Included = append(s.Included, inc.Position())
+	}
+	p.sources[path] = s
+}
+
+//
+//	Field at path was set by something else than a statement.
+//	A section keeps the source it already has.
+//
+func (p *Parser) record(path string, s Source, keep bool) {
+	if p.sources == nil {
+		return
+	}
+	if _, ok := p.sources[path]; ok && keep {
+		return
+	}
+	p.sources[path] = s
+}
+
+//
+//	Forget the sources of the fields in the section at path.
+//
+func (s Sources) drop(path string) {
+	for k := range s {
+		if inPath(k, path) {
+			delete(s, k)
+		}
+	}
+}
+
+// SetSources makes the encoder write the source of each statement and
+// section as a comment at the end of its line, for example the Sources
+// of the Parser that read the struct. Fields that are not in s get no
+// comment.
+func (e *Encoder) SetSources(s Sources) {
+	e.sources = s
+}
+
+//
+//	The comment for the field at path, if any.
+//
+func (e *Encoder) comment(path string) string {
+	s, ok := e.sources[path]
+	if !ok {
+		return ""
+	}
+	return "\t# " + s.String()
+}
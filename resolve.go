@@ -0,0 +1,114 @@
+//
+//	Name resolution for net.IPAddr and net.TCPAddr values.
+//
+
+package curlyconf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A Resolver looks up host names and service names. *net.Resolver
+// implements it; tests can use a fake one.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupPort(ctx context.Context, network, service string) (int, error)
+}
+
+// Settings that are used when converting a value.
+type convContext struct {
+	resolver	Resolver	// nil means net.DefaultResolver
+	noResolve	bool		// only literal addresses
+	convs		map[reflect.Type]ConvertFunc
+}
+
+// Set the resolver that is used for host names in net.IPAddr and
+// net.TCPAddr values. The default is net.DefaultResolver.
+func (p *Parser) SetResolver(r Resolver) {
+	p.conv.resolver = r
+}
+
+// If on is true, host names and service names are not resolved:
+// net.IPAddr and net.TCPAddr values must be literal addresses and
+// port numbers.
+func (p *Parser) SetNoResolve(on bool) {
+	p.conv.noResolve = on
+}
+
+//
+//	The resolver to use.
+//
+func (c *convContext) res() Resolver {
+	if c != nil && c.resolver != nil {
+		return c.resolver
+	}
+	return net.DefaultResolver
+}
+
+//
+//	Split off an IPv6 zone (fe80::1%eth0) and parse a literal address.
+//
+func literalIP(host string) (ip net.IP, zone string) {
+	if i := strings.LastIndexByte(host, '%'); i > 0 && strings.Contains(host, ":") {
+		host, zone = host[:i], host[i+1:]
+	}
+	if ip = net.ParseIP(host); ip == nil {
+		zone = ""
+	}
+	return
+}
+
+//
+//	Resolve a host name or a literal address. Like the net package,
+//	prefer an IPv4 address.
+//
+func (c *convContext) lookupHost(host string) (ip net.IP, zone string, err error) {
+	if ip, zone = literalIP(host); ip != nil {
+		return
+	}
+	if c != nil && c.noResolve {
+		err = fmt.Errorf("cannot resolve host %s: name resolution is disabled", host)
+		return
+	}
+	addrs, err := c.res().LookupIPAddr(context.Background(), host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses")
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot resolve host %s: %s", host, err)
+		return
+	}
+	a := addrs[0]
+	for _, x := range addrs {
+		if x.IP.To4() != nil {
+			a = x
+			break
+		}
+	}
+	return a.IP, a.Zone, nil
+}
+
+//
+//	A port number or a service name.
+//
+func (c *convContext) lookupPort(network, service string) (port int, err error) {
+	if port, err = strconv.Atoi(service); err == nil {
+		if port < 0 || port > 65535 {
+			err = fmt.Errorf("invalid port %s", service)
+		}
+		return
+	}
+	if c != nil && c.noResolve {
+		err = fmt.Errorf("cannot resolve service %s: name resolution is disabled", service)
+		return
+	}
+	if port, err = c.res().LookupPort(context.Background(), network, service); err != nil {
+		err = fmt.Errorf("cannot resolve service %s: %s", service, err)
+	}
+	return
+}
@@ -7,8 +7,16 @@ package curlyconf
 
 import (
 	"encoding"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io/fs"
+	"math"
+	"math/big"
 	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -25,8 +33,6 @@ var nsf = map[string]uint64{
 }
 
 var colonPortRegexp = regexp.MustCompile(`:([0-9]+|[a-z]+[-0-9a-z]*[0-9a-z])$`)
-var ipv4Regexp = regexp.MustCompile(`^([0-9]+\.)[0-9]+$`)
-var ipv6Regexp = regexp.MustCompile(`:.*:`)
 
 var dayRegexp = regexp.MustCompile(`-?\d+d`)
 
@@ -43,31 +49,101 @@ func suffixMult(s string) (r string, m uint64) {
 	return
 }
 
+//
+//	Parse a number: an integer (with an optional 0x, 0o or 0b prefix),
+//	or a decimal number with a fraction and/or an exponent, followed
+//	by an optional k/m/g/t multiplier, but not after 0x. The value is
+//	exact, so that "1.5k" is an integer and overflow can be detected.
+//
+func parseNumber(fn string, s string) (r *big.Rat, err error) {
+	v, mult := s, uint64(1)
+	if u := strings.TrimLeft(s, "-+"); !strings.HasPrefix(u, "0x") &&
+	   !strings.HasPrefix(u, "0X") {
+		v, mult = suffixMult(s)
+	}
+	r = new(big.Rat)
+	if i, ok := new(big.Int).SetString(v, 0); ok {
+		r.SetInt(i)
+	} else if strings.ContainsAny(v, "/xXpP") {
+		err = &strconv.NumError{ Func: fn, Num: s, Err: strconv.ErrSyntax }
+		return
+	} else if i := strings.IndexAny(v, "eE"); i >= 0 && len(v) - i > 5 {
+		// do not let big.Rat compute 10**100000.
+		err = &strconv.NumError{ Func: fn, Num: s, Err: strconv.ErrRange }
+		return
+	} else if _, ok := r.SetString(strings.ReplaceAll(v, "_", "")); !ok {
+		err = &strconv.NumError{ Func: fn, Num: s, Err: strconv.ErrSyntax }
+		return
+	}
+	r.Mul(r, new(big.Rat).SetInt64(int64(mult)))
+	return
+}
+
 func convUint(v string, bits int) (i uint64, e error) {
-	v, mult := suffixMult(v)
-	if i, e = strconv.ParseUint(v, 0, bits); e == nil {
-		i *= mult
+	r, e := parseNumber("ParseUint", v)
+	if e != nil {
+		return
+	}
+	if !r.IsInt() {
+		e = fmt.Errorf("%s is not an integer", v)
+		return
+	}
+	if bits == 0 {
+		bits = strconv.IntSize
+	}
+	n := r.Num()
+	if !n.IsUint64() || n.BitLen() > bits {
+		e = &strconv.NumError{ Func: "ParseUint", Num: v, Err: strconv.ErrRange }
+		return
 	}
+	i = n.Uint64()
 	return
 }
 
 func convInt(v string, bits int) (i int64, e error) {
-	v, mult := suffixMult(v)
-	if i, e = strconv.ParseInt(v, 0, bits); e == nil {
-		i *= int64(mult)
+	r, e := parseNumber("ParseInt", v)
+	if e != nil {
+		return
+	}
+	if !r.IsInt() {
+		e = fmt.Errorf("%s is not an integer", v)
+		return
+	}
+	if bits == 0 {
+		bits = strconv.IntSize
+	}
+	n := r.Num()
+	if n.IsInt64() {
+		i = n.Int64()
+		if bits == 64 || (i >= -1 << (bits - 1) && i < 1 << (bits - 1)) {
+			return
+		}
 	}
+	i = 0
+	e = &strconv.NumError{ Func: "ParseInt", Num: v, Err: strconv.ErrRange }
 	return
 }
 
-func convFloat(v string) (i float64, e error) {
-	v, mult := suffixMult(v)
-	if i, e = strconv.ParseFloat(v, 0); e == nil {
-		i *= float64(mult)
+func convFloat(v string, bits int) (f float64, e error) {
+	r, e := parseNumber("ParseFloat", v)
+	if e != nil {
+		// perhaps inf, nan or a hexadecimal float.
+		return strconv.ParseFloat(v, bits)
+	}
+	if bits == 32 {
+		f32, _ := r.Float32()
+		f = float64(f32)
+	} else {
+		f, _ = r.Float64()
+	}
+	if math.IsInf(f, 0) {
+		f = 0
+		e = &strconv.NumError{ Func: "ParseFloat", Num: v, Err: strconv.ErrRange }
 	}
 	return
 }
 
-func convDuration(v string) (val reflect.Value, e error) {
+func convDuration(v string, c *convContext) (val reflect.Value, e error) {
 
 	// perhaps unquote
 	if len(v) > 0 && v[0] == '"' {
@@ -98,37 +174,60 @@ func convDuration(v string) (val reflect.Value, e error) {
 	return
 }
 
-func convTCPAddr(v string) (val reflect.Value, e error) {
+//
+//	host:port, for TCP and UDP addresses.
+//
+func convHostPort(v string, network string, c *convContext) (ip net.IP, zone string, port int, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
 	if !colonPortRegexp.MatchString(v) {
 		v = v + `:0`
 	}
-	t, e := net.ResolveTCPAddr("tcp", v)
-	if e == nil {
-		var obj interface{}
-		obj = *t
-		val = reflect.ValueOf(obj)
+	host, service, e := net.SplitHostPort(v)
+	if e != nil {
+		return
+	}
+	if host != "" {
+		if ip, zone, e = c.lookupHost(host); e != nil {
+			return
+		}
 	}
+	port, e = c.lookupPort(network, service)
 	return
 }
 
-func convIPAddr(v string) (val reflect.Value, e error) {
-	n := "ip"
-	if ipv4Regexp.MatchString(v) {
-		n = "ip4"
+func convTCPAddr(v string, c *convContext) (val reflect.Value, e error) {
+	t := net.TCPAddr{}
+	if t.IP, t.Zone, t.Port, e = convHostPort(v, "tcp", c); e == nil {
+		val = reflect.ValueOf(t)
 	}
-	if ipv6Regexp.MatchString(v) {
-		n = "ip6"
+	return
+}
+
+func convUDPAddr(v string, c *convContext) (val reflect.Value, e error) {
+	u := net.UDPAddr{}
+	if u.IP, u.Zone, u.Port, e = convHostPort(v, "udp", c); e == nil {
+		val = reflect.ValueOf(u)
 	}
-	ip, e := net.ResolveIPAddr(n, v)
-	if e == nil {
-		var obj interface{}
-		obj = *ip
-		val = reflect.ValueOf(obj)
+	return
+}
+
+func convIPAddr(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	ip := net.IPAddr{}
+	if ip.IP, ip.Zone, e = c.lookupHost(v); e == nil {
+		val = reflect.ValueOf(ip)
 	}
 	return
 }
 
-func convIPNet(v string) (val reflect.Value, e error) {
+func convIPNet(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
 	_, net, e := net.ParseCIDR(v)
 	if e == nil {
 		var obj interface{}
@@ -138,12 +237,184 @@ func convIPNet(v string) (val reflect.Value, e error) {
 	return
 }
 
+func convIP(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		e = fmt.Errorf("invalid IP address %s", v)
+		return
+	}
+	val = reflect.ValueOf(ip)
+	return
+}
+
+func convHardwareAddr(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	mac, e := net.ParseMAC(v)
+	if e == nil {
+		val = reflect.ValueOf(mac)
+	}
+	return
+}
+
+func convUnixAddr(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	if v == "" {
+		e = fmt.Errorf("empty socket path")
+		return
+	}
+	val = reflect.ValueOf(net.UnixAddr{ Name: v, Net: "unix" })
+	return
+}
+
+func convNetipAddr(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	a, e := netip.ParseAddr(v)
+	if e == nil {
+		val = reflect.ValueOf(a)
+	}
+	return
+}
+
+func convNetipPrefix(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	p, e := netip.ParsePrefix(v)
+	if e == nil {
+		val = reflect.ValueOf(p)
+	}
+	return
+}
+
+func convNetipAddrPort(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	ap, e := netip.ParseAddrPort(v)
+	if e == nil {
+		val = reflect.ValueOf(ap)
+	}
+	return
+}
+
+func convURL(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	u, e := url.Parse(v)
+	if e == nil {
+		val = reflect.ValueOf(*u)
+	}
+	return
+}
+
+func convRegexp(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	re, e := regexp.Compile(v)
+	if e == nil {
+		val = reflect.ValueOf(re).Elem()
+	}
+	return
+}
+
+func convMailAddress(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	a, e := mail.ParseAddress(v)
+	if e == nil {
+		val = reflect.ValueOf(*a)
+	}
+	return
+}
+
+// Unix permission bits and the fs.FileMode bits they map to.
+var modeBits = []struct {
+	unix	uint64
+	mode	fs.FileMode
+}{
+	{ 04000, fs.ModeSetuid },
+	{ 02000, fs.ModeSetgid },
+	{ 01000, fs.ModeSticky },
+}
+
 //
-//	Set primitive value - bool, int, float, string
+//	A file mode is octal, with or without a leading 0 or 0o: 0644,
+//	755, 0o1777. The setuid, setgid and sticky bits are mapped to
+//	their fs.FileMode bits.
+//
+func convFileMode(v string, c *convContext) (val reflect.Value, e error) {
+	if v, e = unquote(v); e != nil {
+		return
+	}
+	o := strings.TrimPrefix(strings.TrimPrefix(v, "0o"), "0O")
+	n, err := strconv.ParseUint(o, 8, 32)
+	if err != nil || n > 07777 {
+		e = fmt.Errorf("invalid file mode %s (must be octal, 0 to 07777)", v)
+		return
+	}
+	m := fs.FileMode(n & 0777)
+	for _, b := range modeBits {
+		if n & b.unix != 0 {
+			m |= b.mode
+		}
+	}
+	val = reflect.ValueOf(m)
+	return
+}
+
+//
+//	Format a file mode as octal.
+//
+func formatFileMode(m fs.FileMode) string {
+	n := uint64(m.Perm())
+	for _, b := range modeBits {
+		if m & b.mode != 0 {
+			n |= b.unix
+		}
+	}
+	return fmt.Sprintf("%#04o", n)
+}
+
+// Types that setValue converts itself. canSetValue uses this
+// table too, so these are never mistaken for sections.
+var convSpecial = map[reflect.Type]func(v string, c *convContext) (reflect.Value, error){
+	reflect.TypeOf(net.TCPAddr{}):		convTCPAddr,
+	reflect.TypeOf(net.UDPAddr{}):		convUDPAddr,
+	reflect.TypeOf(net.IPAddr{}):		convIPAddr,
+	reflect.TypeOf(net.IPNet{}):		convIPNet,
+	reflect.TypeOf(net.IP{}):		convIP,
+	reflect.TypeOf(net.HardwareAddr{}):	convHardwareAddr,
+	reflect.TypeOf(net.UnixAddr{}):		convUnixAddr,
+	reflect.TypeOf(netip.Addr{}):		convNetipAddr,
+	reflect.TypeOf(netip.Prefix{}):		convNetipPrefix,
+	reflect.TypeOf(netip.AddrPort{}):	convNetipAddrPort,
+	reflect.TypeOf(url.URL{}):		convURL,
+	reflect.TypeOf(regexp.Regexp{}):	convRegexp,
+	reflect.TypeOf(mail.Address{}):		convMailAddress,
+	reflect.TypeOf(fs.FileMode(0)):		convFileMode,
+	reflect.TypeOf(time.Duration(0)):	convDuration,
+}
+
+//
+//	Set primitive value - bool, integers, floats, complex numbers,
+//	strings and []byte. Named types (type Port uint16) work too.
 //
 func setPrimitive(val reflect.Value, s string) (err error) {
 
-	switch val.Type().Kind() {
+	tp := val.Type()
+	switch tp.Kind() {
 		case reflect.Bool:
 			switch strings.ToLower(s) {
 				case "n", "no", "f", "false", "off":
@@ -153,48 +424,47 @@ func setPrimitive(val reflect.Value, s string) (err error) {
 				default:
 					err = fmt.Errorf("not a boolean value")
 			}
-		case reflect.Uint64:
-			var i uint64
-			if i, err = convUint(s, 64); err == nil {
-				val.SetUint(i)
-			}
-		case reflect.Int64:
-			switch val.Type().String() {
-			default:
-				var i int64
-				if i, err = convInt(s, 64); err == nil {
-					val.SetInt(i)
-				}
-			}
-		case reflect.Uint32:
-			var i uint64
-			if i, err = convUint(s, 32); err == nil {
-				val.SetUint(i)
+		case reflect.Int, reflect.Int8, reflect.Int16,
+		     reflect.Int32, reflect.Int64:
+			var i int64
+			if i, err = convInt(s, tp.Bits()); err == nil {
+				val.SetInt(i)
 			}
-		case reflect.Uint:
+		case reflect.Uint, reflect.Uint8, reflect.Uint16,
+		     reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 			var i uint64
-			if i, err = convUint(s, 0); err == nil {
+			if i, err = convUint(s, tp.Bits()); err == nil {
 				val.SetUint(i)
 			}
-		case reflect.Int:
-			var i int64
-			if i, err = convInt(s, 0); err == nil {
-				val.SetInt(i)
-			}
-		case reflect.Float64:
+		case reflect.Float32, reflect.Float64:
 			var fl float64
-			if fl, err = convFloat(s); err == nil {
+			if s, err = unquote(s); err != nil {
+				break
+			}
+			if fl, err = convFloat(s, tp.Bits()); err == nil {
 				val.SetFloat(fl)
 			}
+		case reflect.Complex64, reflect.Complex128:
+			var c complex128
+			if s, err = unquote(s); err != nil {
+				break
+			}
+			if c, err = strconv.ParseComplex(s, tp.Bits()); err == nil {
+				val.SetComplex(c)
+			}
 		case reflect.String:
-			if len(s) > 0 && s[0] == '"' {
-				s, err = strconv.Unquote(s)
-				if err == nil {
-					val.SetString(s)
-				}
+			if s, err = unquote(s); err == nil {
+				val.SetString(s)
+			}
+		case reflect.Slice:
+			if tp.Elem().Kind() != reflect.Uint8 {
+				err = fmt.Errorf("unsupported type %s", tp.String())
 				break
 			}
-			val.SetString(s)
+			var b []byte
+			if b, err = convBytes(s); err == nil {
+				val.SetBytes(b)
+			}
 		default:
 			err = fmt.Errorf("unsupported type %s",
 						val.Type().String())
@@ -202,42 +472,66 @@ func setPrimitive(val reflect.Value, s string) (err error) {
 	return
 }
 
+func unquote(s string) (string, error) {
+	if len(s) > 0 && s[0] == '"' {
+		return strconv.Unquote(s)
+	}
+	return s, nil
+}
+
 //
-//	Set a field to a value.
+//	[]byte: hex after "hex:", base64 otherwise ("base64:" is
+//	optional). base64 has no ':', so this is never ambiguous.
 //
-func setValue(val reflect.Value, s string) (err error) {
+func convBytes(s string) (b []byte, err error) {
+	if s, err = unquote(s); err != nil {
+		return
+	}
+	if h, ok := strings.CutPrefix(s, "hex:"); ok {
+		return hex.DecodeString(h)
+	}
+	s = strings.TrimPrefix(s, "base64:")
+	if len(s) % 4 != 0 {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
 
-	// If the type complies with the TextUnmarshaler interface, use it.
-	if val.CanInterface() {
-		intf := val.Addr().Interface()
-		if obj, ok := intf.(encoding.TextUnmarshaler); ok {
-			err = obj.UnmarshalText([]byte(s))
-			return
+//
+//	Set a field to a value. c and tok may be nil.
+//
+func setValue(val reflect.Value, s string, tok *tokInfo, c *convContext) (err error) {
+
+	// A registered converter comes first.
+	if fn := c.converter(val.Type()); fn != nil {
+		return setConverted(val, s, fn)
+	}
+
+	// Then types that want to see the token.
+	if val.CanAddr() {
+		if obj, ok := val.Addr().Interface().(Unmarshaler); ok {
+			return obj.UnmarshalCurly(valueOf(s, tok))
 		}
 	}
 
 	// Special support for some types
-	var newval reflect.Value
-	done := true
-	switch val.Type().String() {
-		case "net.TCPAddr":
-			newval, err = convTCPAddr(s)
-		case "net.IPAddr":
-			newval, err = convIPAddr(s)
-		case "net.IPNet":
-			newval, err = convIPNet(s)
-		case "time.Duration":
-			newval, err = convDuration(s)
-		default:
-			done = false
-	}
-	if done {
-		if err == nil {
+	if conv, ok := convSpecial[val.Type()]; ok {
+		var newval reflect.Value
+		if newval, err = conv(s, c); err == nil {
 			val.Set(newval)
 		}
 		return
 	}
 
+	// If the type complies with the TextUnmarshaler interface, use it.
+	if val.CanInterface() {
+		intf := val.Addr().Interface()
+		if obj, ok := intf.(encoding.TextUnmarshaler); ok {
+			err = obj.UnmarshalText([]byte(s))
+			return
+		}
+	}
+
 	// Perhaps a primitive type
 	err = setPrimitive(val, s)
 
@@ -245,20 +539,28 @@ func setValue(val reflect.Value, s string) (err error) {
 }
 
 func canSetValue(t reflect.Type) (r bool) {
+	if _, ok := convSpecial[t]; ok {
+		return true
+	}
+	if (*convContext)(nil).converter(t) != nil {
+		return true
+	}
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return true
+	}
 	switch t.Kind() {
 		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16,
 		     reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8,
-		     reflect.Uint16, reflect.Uint32, reflect.Uint64,
-		     reflect.Float32, reflect.Float64, reflect.String:
+		     reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		     reflect.Float32, reflect.Float64, reflect.Complex64,
+		     reflect.Complex128, reflect.String:
 			r = true
+		case reflect.Slice:
+			// []byte is a single value.
+			r = t.Elem().Kind() == reflect.Uint8
 		case reflect.Struct:
-			switch t.String() {
-			case "net.IPAddr", "net.IPNet", "net.TCPAddr":
-				r = true
-			default:
-				tumtype := reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
-				r = t.Implements(tumtype)
-			}
+			tumtype := reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+			r = t.Implements(tumtype)
 	}
 	return
 }
@@ -12,14 +12,27 @@ import (
 
 type structWriter struct {
 	stru		reflect.Value
+	path		string
+	conv		*convContext
 }
 
 type structField struct {
 	ident		string
+	name		string		// lowercase name of the struct field
+	index		int		// index of the struct field, or -1
+	path		string		// path of the field
+	elemPath	string		// path of the current section
+	tag		*fieldTag
 	val		reflect.Value
 	elem		reflect.Value
 	fieldType	reflect.Type
 	elemType	reflect.Type
+	owner		reflect.Value	// map that this field is an entry of
+	ownerKey	reflect.Value
+	secKey		reflect.Value	// map entry of the current section
+	secElem		reflect.Value
+	conv		*convContext
+	from		int		// first element Section can add to
 }
 
 func upperFirst(s string) (r string) {
@@ -30,7 +43,8 @@ func upperFirst(s string) (r string) {
 }
 
 //
-//	Constructor for structWriter
+//	Constructor for structWriter. The object can also be a
+//	pointer to a map, then the fields are the entries of the map.
 //
 func newStructWriter(obj interface{}) *structWriter {
 	var s structWriter
@@ -41,42 +55,63 @@ func newStructWriter(obj interface{}) *structWriter {
 	default:
 		panic("newStructWriter: object is not a pointer-to-struct")
 	}
-	if s.stru.Kind() != reflect.Struct {
+	if s.stru.Kind() != reflect.Struct && s.stru.Kind() != reflect.Map {
 		panic("newStructWriter: object is not a pointer-to-struct")
 	}
 	return &s
 }
 
+//
+//	Get a description of an entry of a map. Any identifier
+//	is a valid key.
+//
+func (s *structWriter) mapField(k string) (f *structField, err error) {
+	tp := s.stru.Type()
+	key := reflect.New(tp.Key()).Elem()
+	if err = setValue(key, k, nil, s.conv); err != nil {
+		err = fmt.Errorf("invalid key %s: %s", k, err)
+		return
+	}
+	f = &structField{
+		ident: k,
+		name: k,
+		index: -1,
+		path: s.path + "[" + k + "]",
+		tag: newFieldTag(),
+		val: reflect.New(tp.Elem()).Elem(),
+		owner: s.stru,
+		ownerKey: key,
+		conv: s.conv,
+	}
+	if old := s.stru.MapIndex(key); old.IsValid() {
+		f.val.Set(old)
+	}
+	f.setTypes()
+	return
+}
+
 //
 //	Get a description of the field of a struct.
 //
 func (s *structWriter) structField(k string) (f *structField, err error) {
 
-	f = &structField{}
+	if s.stru.Kind() == reflect.Map {
+		return s.mapField(k)
+	}
 
 	idx := -1
 	tp := s.stru.Type()
-	var name string
-	for i := 0; i < tp.NumField(); i++ {
+	for i := 0; i < tp.NumField() && idx < 0; i++ {
 		// skip if first letter is not uppercase
 		sf := tp.Field(i)
-		name = sf.Name
+		name := sf.Name
 		if name[:1] != strings.ToUpper(name[:1]) {
 			continue
 		}
-		// compare fieldname
+		// compare fieldname and tags
 		name = strings.ToLower(name)
-		if name == k {
+		if name == k || parseTag(sf).matches(k) {
 			idx = i
-			break
-		}
-		// compare tags
-		tag := sf.Tag.Get("cc")
-		for _, name = range strings.Split(tag, ",") {
-			if name == k {
-				idx = i
-				break
-			}
 		}
 	}
 
@@ -85,17 +120,44 @@ func (s *structWriter) structField(k string) (f *structField, err error) {
 		err = fmt.Errorf("unknown field %s", k)
 		return
 	}
+	f = s.fieldAt(idx, k)
+	return
+}
 
+//
+//	Get a description of the struct field with index idx,
+//	that was found as k.
+//
+func (s *structWriter) fieldAt(idx int, k string) (f *structField) {
+	sf := s.stru.Type().Field(idx)
+	f = &structField{}
 	f.val = s.stru.Field(idx)
 	if !f.val.CanSet() {
 		msg := fmt.Sprintf("field %s of %s is not assignable",
 						k, s.stru.Type().Name())
 		panic(msg)
 	}
-	f.ident = name
+	f.ident = k
+	f.name = strings.ToLower(sf.Name)
+	f.index = idx
+	f.tag = parseTag(sf)
+	f.path = joinPath(s.path, f.name)
+	f.conv = s.conv
+	f.setTypes()
+	return
+}
 
+//
+//	Find the type of the elements of the field.
+//
+func (f *structField) setTypes() {
 	f.fieldType = f.val.Type()
-	switch f.fieldType.Kind() {
+	kind := f.fieldType.Kind()
+	if f.conv.canSet(f.fieldType) {
+		// a single value, for example []byte.
+		kind = reflect.Invalid
+	}
+	switch kind {
 	case reflect.Slice:
 		// it's a slice of values.
 		f.elemType = f.val.Type().Elem()
@@ -108,11 +170,24 @@ func (s *structWriter) structField(k string) (f *structField, err error) {
 		if f.elemType.Kind() == reflect.Ptr {
 			panic("no support for pointers of pointers to values")
 		}
+	case reflect.Map:
+		// map of values or sections, or pointers to sections.
+		f.elemType = f.val.Type().Elem()
+		if f.elemType.Kind() == reflect.Ptr {
+			f.elemType = f.elemType.Elem()
+		}
 	default:
 		f.elemType = f.fieldType
 	}
+}
 
-	return
+//
+//	A map is a section: either the entries are sections and
+//	their names are the keys, or the section contains a
+//	list of "key value" statements.
+//
+func (f *structField) isMap() bool {
+	return f.fieldType.Kind() == reflect.Map && !f.conv.canSet(f.fieldType)
 }
 
 func (f *structField) IsBool() bool {
@@ -120,17 +195,25 @@ func (f *structField) IsBool() bool {
 }
 
 func (f *structField) IsSlice() bool {
-	return f.fieldType.Kind() == reflect.Slice
+	return f.fieldType.Kind() == reflect.Slice && !f.conv.canSet(f.fieldType)
 }
 
 func (f *structField) IsStruct() bool {
-	if canSetValue(f.elemType) {
+	if f.isMap() {
+		return true
+	}
+	if f.conv.canSet(f.elemType) {
 		return false
 	}
 	return f.elemType.Kind() == reflect.Struct
 }
 
 func (f *structField) HasName() (r bool) {
+	if f.isMap() {
+		k := f.elemType.Kind()
+		return !f.conv.canSet(f.elemType) &&
+			(k == reflect.Struct || k == reflect.Map)
+	}
 	if f.elemType.Kind() == reflect.Struct {
 		_, r = f.elemType.FieldByName("Name_")
 	}
@@ -142,6 +225,9 @@ func (f *structField) HasName() (r bool) {
 //
 func (f *structField) Section(s string) (err error) {
 
+	f.elemPath = f.path
+	index := -1
+
 	// If this is a pointer or a slice, allocate a new Value
 	switch f.fieldType.Kind() {
 		case reflect.Ptr:
@@ -159,8 +245,8 @@ func (f *structField) Section(s string) (err error) {
 			var elem reflect.Value
 			var found bool
 			l := f.val.Len()
-			for i := 0; i < l; i++ {
-				elem = f.val.Index(i)
+			for index = f.from; index < l; index++ {
+				elem = f.val.Index(index)
 				n := elem.FieldByName("Name_")
 				if n.IsValid() && n.String() == s {
 					found = true
@@ -174,31 +260,95 @@ func (f *structField) Section(s string) (err error) {
 				f.val.Set(reflect.Append(f.val, elem))
 				f.elem = f.val.Index(f.val.Len() - 1)
 			}
+		case reflect.Map:
+			if f.val.IsNil() {
+				f.val.Set(reflect.MakeMap(f.fieldType))
+				f.store()
+			}
+			if !f.isMap() || !f.HasName() {
+				f.elem = f.val
+				break
+			}
+			// the name of the section is the key.
+			key := reflect.New(f.fieldType.Key()).Elem()
+			if err = setValue(key, s, nil, f.conv); err != nil {
+				return
+			}
+			f.elemPath = f.path + "[" + s + "]"
+			old := f.val.MapIndex(key)
+			if f.fieldType.Elem().Kind() == reflect.Ptr {
+				if !old.IsValid() || old.IsNil() {
+					old = reflect.New(f.elemType)
+					f.val.SetMapIndex(key, old)
+				}
+				f.elem = old.Elem()
+				break
+			}
+			f.elem = reflect.New(f.elemType).Elem()
+			if old.IsValid() {
+				f.elem.Set(old)
+			}
+			if f.elem.Kind() == reflect.Map && f.elem.IsNil() {
+				f.elem.Set(reflect.MakeMap(f.elemType))
+			}
+			f.secKey, f.secElem = key, f.elem
 		default:
 			f.elem = f.val
 	}
 
 	// Set the name if we can.
-	v := f.elem.FieldByName("Name_")
-	if v.IsValid() {
-		v.SetString(s)
+	if f.elem.Kind() == reflect.Struct {
+		v := f.elem.FieldByName("Name_")
+		if v.IsValid() {
+			v.SetString(s)
+		}
+	}
+	if index >= 0 {
+		f.elemPath = elemPath(f.path, f.val, index)
 	}
 	return
 }
 
+//
+//	Section is done. Map entries are copies, so put them
+//	back into the map.
+//
+func (f *structField) Done() {
+	if f.secKey.IsValid() {
+		f.val.SetMapIndex(f.secKey, f.secElem)
+	}
+	f.store()
+}
+
+//
+//	If this is an entry of a map, store it in the map.
+//
+func (f *structField) store() {
+	if f.owner.IsValid() {
+		f.owner.SetMapIndex(f.ownerKey, f.val)
+	}
+}
+
 
 //
 //	Set a field to a value.
 //
 func (f *structField) Set(s string) (err error) {
+	return f.set(s, nil)
+}
+
+//
+//	Set a field to a value, from token tok (if not nil).
+//
+func (f *structField) set(s string, tok *tokInfo) (err error) {
 
 	// If this is a pointer or a slice, allocate a new Value
-	switch f.fieldType.Kind() {
-		case reflect.Ptr:
+	switch {
+		case f.fieldType.Kind() == reflect.Ptr:
 			elemPtr := reflect.New(f.elemType)
 			f.val.Set(elemPtr)
 			f.elem = reflect.Indirect(elemPtr)
-		case reflect.Slice:
+		case f.IsSlice():
 			elem := reflect.Indirect(reflect.New(f.elemType))
 			f.val.Set(reflect.Append(f.val, elem))
 			f.elem = f.val.Index(f.val.Len() - 1)
@@ -206,7 +356,14 @@ func (f *structField) Set(s string) (err error) {
 			f.elem = f.val
 	}
 
-	err = setValue(f.elem, s)
+	if f.tag.bytesize {
+		err = setByteSize(f.elem, s)
+	} else {
+		err = setValue(f.elem, s, tok, f.conv)
+	}
+	if err == nil {
+		f.store()
+	}
 	return
 }
 
@@ -214,6 +371,16 @@ func (f *structField) PtrToElem() interface{} {
 	return f.elem.Addr().Interface()
 }
 
+//
+//	A structWriter for the current section.
+//
+func (f *structField) writer() *structWriter {
+	sw := newStructWriter(f.PtrToElem())
+	sw.path = f.elemPath
+	sw.conv = f.conv
+	return sw
+}
+
 /*
 type MyType struct {
 	Value	string
@@ -0,0 +1,191 @@
+//
+//	The "cc" struct tag.
+//
+//	A comma separated list of alternative names for the field,
+//	and options:
+//
+//	required	the field must be set in the configuration file.
+//	default=value	value to use if the field is not set.
+//	min=value	minimum value of a number or duration.
+//	max=value	maximum value of a number or duration.
+//	oneof=a|b|c	the value must be one of these.
+//	minlen=n	minimum length of a string.
+//	maxlen=n	maximum length of a string.
+//	minitems=n	minimum number of values in a slice.
+//	maxitems=n	maximum number of values in a slice.
+//	bytesize	the (integer) value is a size, see ByteSize.
+//	merge=how	how a Loader merges this field from several files:
+//			replace, append or name (see loader.go).
+//	match=regexp	the value must match the regular expression.
+//			This must be the last option, everything after
+//			"match=" (including commas) is the expression.
+//
+//	Example: `cc:"port,listen,default=80,min=1,max=65535"`.
+//
+
+package curlyconf
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type fieldTag struct {
+	names		[]string
+	required	bool
+	def		string
+	hasDef		bool
+	min		string
+	max		string
+	minVal		reflect.Value	// min and max, as the type of the field
+	maxVal		reflect.Value
+	boundErr	error		// min or max is invalid
+	checks		bool		// has constraints for check
+	oneof		[]string
+	match		string
+	minlen		int
+	maxlen		int
+	minitems	int
+	maxitems	int
+	bytesize	bool
+	merge		string
+}
+
+func newFieldTag() *fieldTag {
+	return &fieldTag{ minlen: -1, maxlen: -1, minitems: -1, maxitems: -1 }
+}
+
+// parsed tags, by type and tag. A fieldTag is not changed after
+// parseTag, so they can be shared.
+var tagCache sync.Map
+
+type tagKey struct {
+	tp	reflect.Type
+	tag	reflect.StructTag
+}
+
+func parseTag(sf reflect.StructField) (t *fieldTag) {
+	key := tagKey{ sf.Type, sf.Tag }
+	if c, ok := tagCache.Load(key); ok {
+		return c.(*fieldTag)
+	}
+	t = parseTagString(sf.Tag.Get("cc"))
+	if t.min != "" || t.max != "" {
+		t.parseBounds(sf.Type)
+	}
+	tagCache.Store(key, t)
+	return
+}
+
+func parseTagString(tag string) (t *fieldTag) {
+	t = newFieldTag()
+	for tag != "" {
+		item := tag
+		if i := strings.Index(tag, ","); i >= 0 {
+			item, tag = tag[:i], tag[i+1:]
+		} else {
+			tag = ""
+		}
+		key, val := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			key, val = item[:i], item[i+1:]
+		}
+		switch key {
+			case "required":
+				t.required = true
+			case "default":
+				t.def = val
+				t.hasDef = true
+			case "min":
+				t.min = val
+			case "max":
+				t.max = val
+			case "oneof":
+				t.oneof = strings.Split(val, "|")
+			case "match":
+				t.match = val
+				if tag != "" {
+					t.match += "," + tag
+					tag = ""
+				}
+			case "minlen":
+				t.minlen = atoiTag(val)
+			case "maxlen":
+				t.maxlen = atoiTag(val)
+			case "minitems":
+				t.minitems = atoiTag(val)
+			case "maxitems":
+				t.maxitems = atoiTag(val)
+			case "bytesize":
+				t.bytesize = true
+			case "merge":
+				if val != mergeReplace && val != mergeAppend && val != mergeName {
+					panic("curlyconf: invalid merge in cc tag: " + val)
+				}
+				t.merge = val
+			default:
+				t.names = append(t.names, item)
+		}
+	}
+	t.checks = t.min != "" || t.max != "" || len(t.oneof) > 0 ||
+		   t.minlen >= 0 || t.maxlen >= 0 || t.match != ""
+	return
+}
+
+func atoiTag(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic("curlyconf: invalid number in cc tag: " + s)
+	}
+	return n
+}
+
+// Does the field match the identifier k from the config file?
+func (t *fieldTag) matches(k string) bool {
+	for _, n := range t.names {
+		if n == k {
+			return true
+		}
+	}
+	return false
+}
+
+//
+//	Path of a field: "person[snoopy].address".
+//
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+//
+//	Path of element index of a slice: by name if it has one,
+//	otherwise by index. A section that has the same name as an
+//	earlier one (merge=append) is also by index.
+//
+func elemPath(path string, slice reflect.Value, index int) string {
+	elem := slice.Index(index)
+	if elem.Kind() == reflect.Struct {
+		if n := elem.FieldByName("Name_"); n.IsValid() && !nameBefore(slice, index) {
+			return path + "[" + n.String() + "]"
+		}
+	}
+	return path + "[" + strconv.Itoa(index) + "]"
+}
+
+//
+//	Does an element before index have the same Name_?
+//
+func nameBefore(slice reflect.Value, index int) bool {
+	name := slice.Index(index).FieldByName("Name_").String()
+	for i := 0; i < index; i++ {
+		if slice.Index(i).FieldByName("Name_").String() == name {
+			return true
+		}
+	}
+	return false
+}
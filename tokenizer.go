@@ -1,9 +1,12 @@
 package curlyconf
 
 import (
-	"regexp"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"fmt"
+	"path"
+	"path/filepath"
 	"unicode/utf8"
 )
 
@@ -16,16 +19,30 @@ type tokPos struct {
 type tokDef struct {
 	Match	string
 	Token	uint64
-	re	*regexp.Regexp
+	Start	string
+	scan	func(b []byte) int
+}
+
+// A table of tokens, indexed by the first byte.
+type tokTable struct {
+	defs	[]*tokDef
+	first	[256][]*tokDef
 }
 
 type tokenizer struct {
 	file	string
+	abs	string		// absolute path, for include cycle detection
+	fsys	fs.FS		// filesystem the file was read from, if not the OS
 	data	[]byte
 	pos	tokPos
-	tokdef	[]*tokDef
-	space	*regexp.Regexp
+	tokdef	*tokTable
+	space	*[256]bool
 	comment	uint64
+	incl	*tokInfo	// "include" statement that opened this file
+	depth	int		// block depth of that include statement
+	keep	bool		// keep skipped comments in "comments"
+	kept	int
+	comments []*tokInfo
 }
 
 type tokInfo struct {
@@ -42,41 +59,110 @@ const (
 
 const tokAny = 0x00ffffffffffffff
 
-func newtokenizer(data []byte, td []*tokDef) (l *tokenizer)  {
+var defaultSpace = spaceSet(" \t\r")
+
+func spaceSet(spc string) *[256]bool {
+	var set [256]bool
+	for i := 0; i < len(spc); i++ {
+		set[spc[i]] = true
+	}
+	return &set
+}
+
+//
+//	Build a token table. After this it is never changed, so
+//	tokenizers on different goroutines can share it.
+//
+func newTokTable(td []*tokDef) (t *tokTable) {
+	t = &tokTable{ defs: td }
+	for _, d := range td {
+		for i := 0; i < len(d.Start); i++ {
+			t.first[d.Start[i]] = append(t.first[d.Start[i]], d)
+		}
+	}
+	return
+}
+
+func newtokenizer(data []byte, td *tokTable) (l *tokenizer)  {
 	l = &tokenizer{ 
 		file: `[internal]`,
 		data: data,
 		tokdef: td,
-		space: regexp.MustCompile(`^[\r\t ]+`),
+		space: defaultSpace,
 		pos: tokPos{Line: 1, Column: 1},
 	}
-	for i := range td {
-		td[i].re = regexp.MustCompile("^" + td[i].Match)
-	}
 	return
 }
 
-func newTokenizerFromString(data string, td []*tokDef) (l *tokenizer, err error)  {
+func newTokenizerFromString(data string, td *tokTable) (l *tokenizer, err error)  {
 	l = newtokenizer([]byte(data), td)
 	return
 }
 
-func newTokenizer(fn string, td []*tokDef) (l *tokenizer, err error)  {
+func newTokenizer(fn string, td *tokTable) (l *tokenizer, err error)  {
 	data, err := ioutil.ReadFile(fn)
 	if err != nil {
 		return
 	}
 	l = newtokenizer(data, td)
 	l.file = fn
+	l.abs, err = filepath.Abs(fn)
+	return
+}
+
+func newTokenizerFromReader(r io.Reader, name string, td *tokTable) (l *tokenizer, err error)  {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	l = newtokenizer(data, td)
+	l.file = name
+	l.abs, err = filepath.Abs(name)
 	return
 }
 
+func newTokenizerFS(fsys fs.FS, fn string, td *tokTable) (l *tokenizer, err error)  {
+	data, err := fs.ReadFile(fsys, fn)
+	if err != nil {
+		return
+	}
+	l = newtokenizer(data, td)
+	l.file = fn
+	l.abs = path.Clean(fn)
+	l.fsys = fsys
+	return
+}
+
+// Position of a token, in the exported form.
+func (t *tokInfo) Position() Position {
+	return Position{
+		File: t.tkz.file,
+		Line: t.Pos.Line,
+		Column: t.Pos.Column,
+		Offset: t.Pos.offset,
+	}
+}
+
+// Position just after a token.
+func (t *tokInfo) EndPosition() Position {
+	p := t.Position()
+	for _, c := range t.Value {
+		p.Column++
+		if c == '\n' {
+			p.Line++
+			p.Column = 1
+		}
+	}
+	p.Offset += len(t.Value)
+	return p
+}
+
 func (l *tokenizer) SetPos(t *tokInfo) {
 	l.pos = t.Pos
 }
 
 func (l *tokenizer) SetSpace(spc string) {
-	l.space = regexp.MustCompile(`^[` + spc + `]+`)
+	l.space = spaceSet(spc)
 }
 
 func (l *tokenizer) IgnoreComments(c uint64) {
@@ -98,10 +184,12 @@ func (l *tokenizer) updatePos(s []byte) {
 }
 
 func (l *tokenizer) skipSpace() {
-	s := l.space.Find(l.data[l.pos.offset:])
-	if s != nil {
-		//fmt.Printf("space found len %d\n", len(s))
-		l.updatePos(s)
+	i := l.pos.offset
+	for i < len(l.data) && l.space[l.data[i]] {
+		i++
+	}
+	if i > l.pos.offset {
+		l.updatePos(l.data[l.pos.offset:i])
 	}
 }
 
@@ -120,19 +208,27 @@ func (l *tokenizer) peek() (t *tokInfo) {
 	t.Token = tokUnknown
 	matchlen := -1
 
-	for i := range l.tokdef {
-		s := l.tokdef[i].re.Find(l.data[l.pos.offset:])
-		if s != nil && len(s) >= matchlen {
-			if len(s) == matchlen {
-				t.Token |= l.tokdef[i].Token
+	// The token is the longest match. If more than one token
+	// has that length, it has all their classes.
+	b := l.data[l.pos.offset:]
+	for _, d := range l.tokdef.first[b[0]] {
+		n := d.scan(b)
+		if n > 0 && n >= matchlen {
+			if n == matchlen {
+				t.Token |= d.Token
 			} else {
-				matchlen = len(s)
-				t.Token = l.tokdef[i].Token
-				t.Value = s
+				matchlen = n
+				t.Token = d.Token
+				t.Value = b[:n:n]
 			}
-			//fmt.Printf("peek: %d match: %s\n", matchlen, l.tokdef[i].re.String())
 		}
 	}
+
+	// An unknown token is one character, so that it can be skipped.
+	if matchlen < 0 {
+		_, n := utf8.DecodeRune(b)
+		t.Value = b[:n:n]
+	}
 	return
 }
 
@@ -142,6 +238,10 @@ func (l *tokenizer) Peek() (t *tokInfo) {
 		if (t.Token & l.comment) == 0 {
 			break
 		}
+		if l.keep && t.Pos.offset >= l.kept {
+			l.comments = append(l.comments, t)
+			l.kept = t.Pos.offset + len(t.Value)
+		}
 		l.updatePos(t.Value)
 	}
 	return
@@ -155,8 +255,47 @@ func (l *tokenizer) Next() (t *tokInfo) {
 	return
 }
 
+//
+//	Directory of the file this tokenizer reads. Relative paths
+//	in the file are relative to this directory.
+//
+func (l *tokenizer) Dir() string {
+	if l.abs == "" {
+		return ""
+	}
+	if l.fsys != nil {
+		return path.Dir(l.file)
+	}
+	return filepath.Dir(l.file)
+}
+
+//
+//	Returns the "file:line" positions of the include statements
+//	that led to this token, innermost first.
+//
+func (t *tokInfo) IncludeChain() (ret []string) {
+	for inc := t.tkz.incl; inc != nil; inc = inc.tkz.incl {
+		ret = append(ret, fmt.Sprintf("%s:%d", inc.tkz.file, inc.Pos.Line))
+	}
+	return
+}
+
 func (t *tokInfo) Error(txt string) (ret []string) {
 
+	// Like a C compiler, first show how we got into this file.
+	chain := t.IncludeChain()
+	for i, c := range chain {
+		sep := ","
+		if i == len(chain) - 1 {
+			sep = ":"
+		}
+		if i == 0 {
+			ret = append(ret, "In file included from " + c + sep)
+		} else {
+			ret = append(ret, "                 from " + c + sep)
+		}
+	}
+
 	ret = append(ret, fmt.Sprintf("%s:%d.%d: ",
 			t.tkz.file, t.Pos.Line, t.Pos.Column) + txt)
 	if t.Token == tokEOF {
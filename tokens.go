@@ -1,10 +1,22 @@
 package curlyconf
 
+import (
+	"io"
+	"io/fs"
+)
+
+const re_int string = `[-+]?(0[xX](_?[0-9a-fA-F])+|(0[oO](_?[0-7])+|0[bB](_?[01])+|` +
+			`\d(_?\d)*)[kKmMgGtT]?)`
+const re_float string = `[-+]?\d(_?\d)*(\.\d(_?\d)*)?([eE][-+]?\d(_?\d)*)?[kKmMgGtT]?`
+
+const re_size string = `\d(_?\d)*(\.\d(_?\d)*)?([eE][-+]?\d(_?\d)*)?` +
+			`([kKmMgGtTpPeE]i?)?[bB]`
+
 const re_ident string = `[a-zA-Z][a-zA-Z0-9-]*[a-zA-Z0-9]*`
 
 const re_filename string = `\.{0,2}/[0-9a-zA-Z./_-]+`
 
-const re_dqstring string = `"(?:\\"|[^"])+(:?"|$)`
+const re_dqstring string = `"(?:(?:\\"|[^"])+(:?"|$)|")`
 const re_bqstring string = "`[^`]*(:?`|$)"
 
 const re_hostname string = `(?i:([0-9a-z][0-9a-z-]*[0-9a-z]|[0-9a-z]+)` +
@@ -22,7 +34,12 @@ const re_ipv6port string = `(\[` + re_ipv6 + `\]:\d+)`
 const re_ngmatch string =
 	`[@!]?[0-9a-z+_*]+(\.[0-9a-z+_*]+)*`
 
-const re_comment string = `(//|#)[^\n]*(?:\n|$)`
+const re_var string = `([^\s;,{}()"'#=$]|\$?\$\{[^}\n]*\})*\$?\$\{[^}\n]*\}` +
+			`([^\s;,{}()"'#=$]|\$?\$\{[^}\n]*\})*`
+
+// A comment does not include the newline at the end: for ParserNL and
+// ParserDiablo that is the end of the statement.
+const re_comment string = `(//|#)[^\n]*`
 
 const (
 	tokNL = 1 << iota
@@ -50,35 +67,91 @@ const (
 	tokEnd
 	tokComment
 	tokValue
+	tokSize
+	tokVar
+)
+
+// TokenClass is a set of token classes. The tokenizer classifies each
+// token as all of the classes it matches; for example 10 is both
+// an integer and a float, and 10.0.0.1 is an IPv4 address as well
+// as a hostname.
+type TokenClass uint64
+
+// Token classes of values.
+const (
+	ClassInt	TokenClass = tokInt
+	ClassFloat	TokenClass = tokFloat
+	ClassString	TokenClass = tokString
+	ClassIdent	TokenClass = tokIdent
+	ClassFilename	TokenClass = tokFilename
+	ClassHostname	TokenClass = tokHostname
+	ClassHostPort	TokenClass = tokHostPort
+	ClassIP		TokenClass = tokIP
+	ClassIPv4	TokenClass = tokIPv4
+	ClassIPv6	TokenClass = tokIPv6
+	ClassIPPort	TokenClass = tokIpPort
+	ClassIPv4Port	TokenClass = tokIPv4Port
+	ClassIPv6Port	TokenClass = tokIPv6Port
+	ClassNgMatch	TokenClass = tokNgMatch
+	ClassSize	TokenClass = tokSize
+	ClassVar	TokenClass = tokVar		// has ${name} in it
 )
 
-var tokdef = []*tokDef{
-	&tokDef{ Match: "\n", Token: tokNL },
-	&tokDef{ Match: `{`, Token: tokLCBrace },
-	&tokDef{ Match: `}`, Token: tokRCBrace },
-	&tokDef{ Match: `\(`, Token: tokLBrace },
-	&tokDef{ Match: `\)`, Token: tokRBrace },
-	&tokDef{ Match: `,`, Token: tokComma },
-	&tokDef{ Match: `;`, Token: tokSemi },
-	&tokDef{ Match: `=`, Token: tokEqual },
-	&tokDef{ Match: `\*`, Token: tokIP|tokIPv4|tokValue },
-	&tokDef{ Match: `\d+[kKmMgGtT]`, Token: tokInt|tokValue },
-	&tokDef{ Match: `\d+`, Token: tokInt|tokFloat|tokValue },
-	&tokDef{ Match: `\d+\.\d+`, Token: tokFloat|tokValue },
-	&tokDef{ Match: re_dqstring, Token: tokString|tokValue },
-	&tokDef{ Match: re_ident, Token: tokIdent|tokValue },
-	&tokDef{ Match: re_filename, Token: tokFilename|tokValue },
-	&tokDef{ Match: re_hostname, Token: tokHostname|tokValue },
-	&tokDef{ Match: re_hostport, Token: tokHostPort|tokValue },
-	&tokDef{ Match: re_ipv4,  Token: tokIP|tokIPv4|tokValue },
-	&tokDef{ Match: re_ipv4port,  Token: tokIpPort|tokIPv4Port|tokValue },
-	&tokDef{ Match: re_ipv6, Token: tokIP|tokIPv6|tokValue },
-	&tokDef{ Match: re_ipv6port,  Token: tokIpPort|tokIPv6Port|tokValue },
-	&tokDef{ Match: re_ngmatch,  Token: tokNgMatch|tokValue },
-	&tokDef{ Match: `end`, Token: tokEnd|tokValue },
-	&tokDef{ Match: `(//|#)[^\n]*(?:\n|$)`, Token: tokComment },
+// Has reports whether c includes (one of) the classes in o.
+func (c TokenClass) Has(o TokenClass) bool {
+	return (c & o) != 0
 }
 
+// The token table. It is built once and read-only after that.
+//
+// Match is the regular expression that describes the token; scan is
+// the hand-written scanner that matches the same. Start has the bytes
+// a token can start with.
+var tokdef = newTokTable([]*tokDef{
+	&tokDef{ Match: "\n", Token: tokNL, Start: "\n", scan: scanLit("\n") },
+	&tokDef{ Match: `{`, Token: tokLCBrace, Start: "{", scan: scanLit("{") },
+	&tokDef{ Match: `}`, Token: tokRCBrace, Start: "}", scan: scanLit("}") },
+	&tokDef{ Match: `\(`, Token: tokLBrace, Start: "(", scan: scanLit("(") },
+	&tokDef{ Match: `\)`, Token: tokRBrace, Start: ")", scan: scanLit(")") },
+	&tokDef{ Match: `,`, Token: tokComma, Start: ",", scan: scanLit(",") },
+	&tokDef{ Match: `;`, Token: tokSemi, Start: ";", scan: scanLit(";") },
+	&tokDef{ Match: `=`, Token: tokEqual, Start: "=", scan: scanLit("=") },
+	&tokDef{ Match: `\*`, Token: tokIP|tokIPv4|tokValue, Start: "*",
+		scan: scanLit("*") },
+	&tokDef{ Match: re_int, Token: tokInt|tokValue, Start: chDigit + "-+",
+		scan: scanInt },
+	&tokDef{ Match: re_float, Token: tokFloat|tokValue, Start: chDigit + "-+",
+		scan: scanFloat },
+	&tokDef{ Match: re_size, Token: tokSize|tokValue, Start: chDigit,
+		scan: scanSize },
+	&tokDef{ Match: re_dqstring, Token: tokString|tokValue, Start: `"`,
+		scan: scanDQString },
+	&tokDef{ Match: re_ident, Token: tokIdent|tokValue, Start: chLower + chUpper,
+		scan: scanIdent },
+	&tokDef{ Match: re_filename, Token: tokFilename|tokValue, Start: "./",
+		scan: scanFilename },
+	&tokDef{ Match: re_hostname, Token: tokHostname|tokValue,
+		Start: chDigit + chLower + chUpper + chFold, scan: scanHostname },
+	&tokDef{ Match: re_hostport, Token: tokHostPort|tokValue,
+		Start: chDigit + chLower + chUpper + chFold, scan: scanHostPort },
+	&tokDef{ Match: re_ipv4,  Token: tokIP|tokIPv4|tokValue, Start: chDigit,
+		scan: scanIPv4 },
+	&tokDef{ Match: re_ipv4port,  Token: tokIpPort|tokIPv4Port|tokValue,
+		Start: chDigit + "*", scan: scanIPv4Port },
+	&tokDef{ Match: re_ipv6, Token: tokIP|tokIPv6|tokValue, Start: chHex + ":",
+		scan: scanIPv6 },
+	&tokDef{ Match: re_ipv6port,  Token: tokIpPort|tokIPv6Port|tokValue,
+		Start: "[", scan: scanIPv6Port },
+	&tokDef{ Match: re_ngmatch,  Token: tokNgMatch|tokValue,
+		Start: "@!+_*" + chDigit + chLower, scan: scanNgMatch },
+	&tokDef{ Match: `end`, Token: tokEnd|tokValue, Start: "e",
+		scan: scanLit("end") },
+	&tokDef{ Match: re_var, Token: tokVar|tokValue, Start: chVar,
+		scan: scanVar },
+	&tokDef{ Match: re_comment, Token: tokComment, Start: "#/",
+		scan: scanComment },
+})
+
 func confTokenizer(file string) (t *tokenizer, err error) {
 	t, err = newTokenizer(file, tokdef)
 	if err == nil {
@@ -97,3 +170,21 @@ func confTokenizerFromString(data string) (t *tokenizer, err error) {
 	return
 }
 
+func confTokenizerFromReader(r io.Reader, name string) (t *tokenizer, err error) {
+	t, err = newTokenizerFromReader(r, name, tokdef)
+	if err == nil {
+		t.IgnoreComments(tokComment)
+		t.SetSpace(" \t\r\n")
+	}
+	return
+}
+
+func confTokenizerFS(fsys fs.FS, file string) (t *tokenizer, err error) {
+	t, err = newTokenizerFS(fsys, file, tokdef)
+	if err == nil {
+		t.IgnoreComments(tokComment)
+		t.SetSpace(" \t\r\n")
+	}
+	return
+}
+
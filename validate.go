@@ -0,0 +1,300 @@
+//
+//	Check the constraints from the "cc" struct tag
+//	(min, max, oneof, match, minlen, maxlen, minitems, maxitems),
+//	and call the Validate and ValidateSection methods of sections.
+//
+//	There are two hooks because a section can be spread over the
+//	file ("person snoopy { .. }" and later "person snoopy address
+//	5.6.7.8;"), so the end of a section is not the end of its data.
+//
+//	Validate (or ValidateAt) is the one to use for rules about the
+//	section: it is called once, with the complete section and its
+//	defaults, and errors are at the first header of the section.
+//	ValidateSection is for rules about one part as it is written,
+//	for example a block that must not be empty: it is called at the
+//	end of every part, with what has been read so far, and errors
+//	are at the header of that part. It is not called for the top
+//	level, which has no header.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A section (struct) that implements Validator is checked after the
+// whole file has been read, when its defaults have been filled in and
+// the sections in it have been validated. An error is reported at
+// the (first) header of the section. This is the hook for rules about
+// the contents of a section; see SectionValidator for the difference.
+type Validator interface {
+	Validate() error
+}
+
+// Like Validator, but the method also gets the position of the
+// section header (or the start of the file, for the top level).
+type PositionValidator interface {
+	ValidateAt(pos Position) error
+}
+
+// A section that implements SectionValidator is also checked when the
+// parser reaches the end of it, before the rest of the file has been
+// read: defaults are not filled in yet, and a section that is spread
+// over the file is checked at the end of every part, with what it has
+// so far. pos is the header of that part. An error is reported at the
+// header, and parsing continues.
+//
+// Use it only for rules about a part as written; a rule that needs
+// the whole section belongs in Validate, which can see all parts. A
+// section can implement both.
+type SectionValidator interface {
+	ValidateSection(pos Position) error
+}
+
+// compiled "match=" expressions.
+var matchCache sync.Map
+
+//
+//	Set a field to the value of token tok, and check the constraints.
+//
+func (p *Parser) setField(f *structField, tok *tokInfo, s string) {
+	err := f.set(s, tok)
+	code := CodeValue
+	if err == nil {
+		err = f.tag.check(f.elem)
+		code = CodeConstraint
+	}
+	if err != nil {
+		p.errorErr(tok, code, err)
+	}
+}
+
+//
+//	Call the Validate or ValidateAt method of a section.
+//
+func (p *Parser) validate(v reflect.Value, st *sectionState) {
+	if !v.CanAddr() {
+		return
+	}
+	var tok *tokInfo
+	pos := Position{ Line: 1, Column: 1 }
+	if st != nil && st.tok != nil {
+		tok = st.tok
+		pos = tok.Position()
+	} else if len(p.files) > 0 {
+		pos.File = p.files[0]
+	}
+
+	var err error
+	switch x := v.Addr().Interface().(type) {
+		case PositionValidator:
+			err = x.ValidateAt(pos)
+		case Validator:
+			err = x.Validate()
+		default:
+			return
+	}
+	if err == nil {
+		return
+	}
+	msg := err.Error()
+	if tok != nil {
+		msg = "section " + string(tok.Value) + ": " + msg
+	} else if pos.File != "" {
+		msg = pos.File + ": " + msg
+	}
+	p.report(tok, CodeValidate, msg, err)
+}
+
+//
+//	The end of a section (or a part of it) with header tok:
+//	call its ValidateSection method.
+//
+func (p *Parser) validateSection(f *structField, tok *tokInfo) {
+	v := f.elem
+	if v.Kind() != reflect.Struct || !v.CanAddr() {
+		return
+	}
+	x, ok := v.Addr().Interface().(SectionValidator)
+	if !ok {
+		return
+	}
+	if err := x.ValidateSection(tok.Position()); err != nil {
+		p.report(tok, CodeValidate, err.Error(), err)
+	}
+}
+
+//
+//	Check a value against the constraints.
+//
+func (t *fieldTag) check(v reflect.Value) (err error) {
+	if !t.checks {
+		return
+	}
+	if t.boundErr != nil {
+		return t.boundErr
+	}
+	if t.min != "" && compareBound(v, t.minVal) < 0 {
+		return fmt.Errorf("value %v is less than the minimum %s",
+			v.Interface(), t.min)
+	}
+	if t.max != "" && compareBound(v, t.maxVal) > 0 {
+		return fmt.Errorf("value %v is more than the maximum %s",
+			v.Interface(), t.max)
+	}
+	if len(t.oneof) == 0 && t.minlen < 0 && t.maxlen < 0 && t.match == "" {
+		return
+	}
+
+	s := valueString(v)
+	if len(t.oneof) > 0 {
+		found := false
+		for _, o := range t.oneof {
+			if o == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("value %s must be one of %s", s,
+				strings.Join(t.oneof, ", "))
+		}
+	}
+	if t.minlen >= 0 && utf8.RuneCountInString(s) < t.minlen {
+		return fmt.Errorf("value %s is shorter than %d characters",
+			s, t.minlen)
+	}
+	if t.maxlen >= 0 && utf8.RuneCountInString(s) > t.maxlen {
+		return fmt.Errorf("value %s is longer than %d characters",
+			s, t.maxlen)
+	}
+	if t.match != "" {
+		re, err := compileMatch(t.match)
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(s) {
+			return fmt.Errorf("value %s does not match %s", s, t.match)
+		}
+	}
+	return
+}
+
+//
+//	Check the number of items in a slice.
+//
+func (t *fieldTag) checkItems(v reflect.Value) (err error) {
+	if v.Kind() != reflect.Slice {
+		return
+	}
+	n := v.Len()
+	if t.minitems >= 0 && n < t.minitems {
+		err = fmt.Errorf("has %d values, minimum is %d", n, t.minitems)
+	}
+	if t.maxitems >= 0 && n > t.maxitems {
+		err = fmt.Errorf("has %d values, maximum is %d", n, t.maxitems)
+	}
+	return
+}
+
+//
+//	Convert min and max to the type of the values of a field of
+//	type tp, as a size if the field has the bytesize option. This
+//	is done once, in parseTag; an error is returned by check.
+//
+func (t *fieldTag) parseBounds(tp reflect.Type) {
+	for tp.Kind() == reflect.Ptr ||
+	    (tp.Kind() == reflect.Slice && !canSetValue(tp)) {
+		tp = tp.Elem()
+	}
+	switch tp.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16,
+		     reflect.Int32, reflect.Int64,
+		     reflect.Uint, reflect.Uint8, reflect.Uint16,
+		     reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		     reflect.Float32, reflect.Float64:
+		default:
+			t.boundErr = fmt.Errorf("min/max: %s is not a number", tp)
+			return
+	}
+	if t.minVal, t.boundErr = parseBound(tp, t.min, t.bytesize); t.boundErr != nil {
+		return
+	}
+	t.maxVal, t.boundErr = parseBound(tp, t.max, t.bytesize)
+}
+
+func parseBound(tp reflect.Type, bound string, bytesize bool) (b reflect.Value, err error) {
+	if bound == "" {
+		return
+	}
+	b = reflect.New(tp).Elem()
+	if bytesize {
+		err = setByteSize(b, bound)
+	} else {
+		err = setValue(b, bound, nil, nil)
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid bound %s: %s", bound, err)
+	}
+	return
+}
+
+//
+//	Compare a number (or duration) with a bound from the tag,
+//	which has the same type.
+//
+func compareBound(v, b reflect.Value) (c int) {
+	switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16,
+		     reflect.Int32, reflect.Int64:
+			x, y := v.Int(), b.Int()
+			c = cmp(x < y, x > y)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16,
+		     reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			x, y := v.Uint(), b.Uint()
+			c = cmp(x < y, x > y)
+		case reflect.Float32, reflect.Float64:
+			x, y := v.Float(), b.Float()
+			c = cmp(x < y, x > y)
+	}
+	return
+}
+
+func cmp(less, more bool) int {
+	switch {
+		case less:
+			return -1
+		case more:
+			return 1
+	}
+	return 0
+}
+
+//
+//	The value as a string, for oneof, match and len.
+//
+func valueString(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func compileMatch(expr string) (re *regexp.Regexp, err error) {
+	if r, ok := matchCache.Load(expr); ok {
+		return r.(*regexp.Regexp), nil
+	}
+	re, err = regexp.Compile(expr)
+	if err != nil {
+		err = fmt.Errorf("invalid match expression %s: %s", expr, err)
+		return
+	}
+	matchCache.Store(expr, re)
+	return
+}
@@ -0,0 +1,191 @@
+//
+//	Variables.
+//
+//	set base /srv/app;
+//	logdir ${base}/log;
+//	motd "Welcome to ${name}";
+//
+//	A variable is visible in the section it is set in and in the
+//	sections in it, from the set statement on. A variable that is
+//	set again in an inner section hides the outer one until the
+//	end of that section. ${name} is replaced in values, section
+//	names and include filenames; $${ is a literal ${, and that
+//	is how the Encoder writes a ${ if SetExpandVars is on.
+//
+//	${env:NAME} is an environment variable, see env.go.
+//
+//	All of this is off by default, so that a ${ in an existing
+//	file keeps its meaning. SetExpandVars turns it on.
+//
+
+package curlyconf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Variables of a section.
+type varScope struct {
+	vars	map[string]string
+	parent	*varScope
+}
+
+// SetExpandVars turns on the set statement and the expansion of
+// ${name} (default off). When it is off, "set" is an unknown field
+// like any other, and a ${ in a value is just text. When it is on,
+// "set" is a reserved word: a field called Set, or a key "set" in
+// a map section, cannot be set from a file. SetVar and AllowEnv
+// turn it on too.
+func (p *Parser) SetExpandVars(on bool) {
+	p.expandVars = on
+}
+
+// SetVar sets a variable, as if the file started with
+// "set name value;". Values are not expanded.
+func (p *Parser) SetVar(name, value string) {
+	p.expandVars = true
+	p.setVar(name, value)
+}
+
+//
+//	Set a variable in the current section.
+//
+func (p *Parser) setVar(name, value string) {
+	if p.scope == nil {
+		p.scope = &varScope{}
+	}
+	if p.scope.vars == nil {
+		p.scope.vars = map[string]string{}
+	}
+	p.scope.vars[name] = value
+}
+
+//
+//	Enter a section.
+//
+func (p *Parser) pushScope() {
+	p.scope = &varScope{ parent: p.scope }
+}
+
+//
+//	Leave a section.
+//
+func (p *Parser) popScope() {
+	if p.scope != nil {
+		p.scope = p.scope.parent
+	}
+}
+
+//
+//	Look up a variable.
+//
+func (p *Parser) lookupVar(name string) (v string, ok bool) {
+	for s := p.scope; s != nil; s = s.parent {
+		if v, ok = s.vars[name]; ok {
+			return
+		}
+	}
+	return
+}
+
+//
+//	The value of ${name}.
+//
+func (p *Parser) varValue(name string) (v string, err error) {
+	if strings.HasPrefix(name, "env:") {
+		return p.envValue(name[4:])
+	}
+	v, ok := p.lookupVar(name)
+	if !ok {
+		err = fmt.Errorf("undefined variable %s", name)
+	}
+	return
+}
+
+//
+//	The set statement. "stok" is the "set" keyword.
+//
+func (p *Parser) set(stok *tokInfo) {
+	name, ok := p.expect(tokIdent, "variable name")
+	if !ok {
+		p.recover(name)
+		return
+	}
+	val, ok := p.expect(tokValue, "value")
+	if !ok {
+		p.recover(val)
+		return
+	}
+	if end, ok := p.expect(p.stmtEnd, p.stmtEndStr); !ok {
+		p.recover(end)
+		return
+	}
+	p.define(name, val, string(val.Value))
+}
+
+//
+//	Set a variable to the (expanded, unquoted) value s of token val.
+//
+func (p *Parser) define(name *tokInfo, val *tokInfo, s string) {
+	s, ok := p.expand(val, s)
+	if !ok {
+		return
+	}
+	if u, err := unquote(s); err == nil {
+		s = u
+	}
+	p.setVar(string(name.Value), s)
+}
+
+//
+//	Replace ${name} in the value s of token tok. A quoted string is
+//	unquoted first, and quoted again after. Reports an error and
+//	returns false if a variable is not defined.
+//
+func (p *Parser) expand(tok *tokInfo, s string) (r string, ok bool) {
+	if !p.expandVars || !strings.Contains(s, "${") {
+		return s, true
+	}
+	quoted := len(s) > 0 && s[0] == '"'
+	if quoted {
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			return s, true
+		}
+		s = u
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			// $${ is a literal ${
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			p.report(tok, CodeVariable, "unterminated ${ in " + s[i:], nil)
+			return
+		}
+		v, err := p.varValue(s[i+2 : i+j])
+		if err != nil {
+			p.report(tok, CodeVariable, err.Error(), err)
+			return
+		}
+		b.WriteString(v)
+		s = s[i+j+1:]
+	}
+	r = b.String()
+	if quoted {
+		r = strconv.Quote(r)
+	}
+	return r, true
+}